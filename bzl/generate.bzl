@@ -4,10 +4,15 @@ load(
     "gazelle_binary",
 )
 
-def generate():
+_languages = {
+    "legacy": "@okapi//lang",
+    "rules_ocaml": "@okapi//lang/rules_ocaml",
+}
+
+def generate(backend = "legacy"):
     gazelle_binary(
         name = "gazelle_binary",
-        languages = ["@okapi//lang"],
+        languages = [_languages[backend]],
     )
     gazelle(
         name = "gazelle",
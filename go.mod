@@ -4,3 +4,4 @@ go 1.16
 
 require github.com/bazelbuild/bazel-gazelle v0.23.0
 require github.com/bazelbuild/rules_go v0.28.0
+require github.com/bazelbuild/buildtools v0.0.0-20200718160251-b1667ff58f71
@@ -0,0 +1,446 @@
+package okapi
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// A Dune `rule` stanza, translated to a genrule.
+type DuneRule struct {
+	targets []string
+	// The labels of the dependencies
+	srcs []string
+	cmd  string
+	// `enabled_if`, or nil
+	enabledIf Compatibility
+}
+
+// The actions that can be translated to shell commands.
+var duneActions = []string{"run", "with-stdout-to", "copy", "system", "bash"}
+
+// The files and named dependencies of a rule, which are referred to by `$(location)` in the command.
+type actionContext struct {
+	targets []string
+	deps    []string
+	named   map[string]string
+	// The programs from `%{bin:...}`, which are looked up in the `PATH` of the build
+	tools []string
+	// Words of shell commands that look like relative paths, but aren't dependencies or targets
+	relative []string
+}
+
+func (ctx *actionContext) addDep(file string) {
+	ctx.deps = appendUnique(ctx.deps, file)
+}
+
+func fileLabel(file string) (string, error) {
+	if strings.HasPrefix(file, "../") || strings.HasPrefix(file, "/") {
+		return "", fmt.Errorf("file outside of the package: %s", file)
+	}
+	return ":" + path.Clean(file), nil
+}
+
+func location(file string) (string, error) {
+	label, err := fileLabel(file)
+	if err != nil {
+		return "", err
+	}
+	return "$(location " + label + ")", nil
+}
+
+var duneVariable = regexp.MustCompile(`%\{([^}]*)\}`)
+
+// Replace Dune variables like `%{targets}` or `%{dep:file}` with their genrule counterparts.
+func (ctx *actionContext) expand(arg string) (string, error) {
+	var failure error
+	result := duneVariable.ReplaceAllStringFunc(arg, func(match string) string {
+		name := duneVariable.FindStringSubmatch(match)[1]
+		var expanded string
+		var err error
+		if name == "targets" || name == "target" {
+			expanded = "$(OUTS)"
+		} else if name == "deps" {
+			expanded = "$(SRCS)"
+		} else if strings.HasPrefix(name, "dep:") {
+			file := strings.TrimPrefix(name, "dep:")
+			ctx.addDep(file)
+			expanded, err = location(file)
+		} else if strings.HasPrefix(name, "bin:") {
+			expanded = strings.TrimPrefix(name, "bin:")
+			ctx.tools = appendUnique(ctx.tools, expanded)
+		} else if file, isNamed := ctx.named[name]; isNamed {
+			expanded, err = location(file)
+		} else {
+			err = fmt.Errorf("unsupported variable %s", match)
+		}
+		if err != nil && failure == nil {
+			failure = err
+		}
+		return expanded
+	})
+	return result, failure
+}
+
+// Arguments that name a target or dependency are relative to the directory of the dune file, so they are replaced by
+// their locations.
+func (ctx *actionContext) expandFile(arg string) (string, error) {
+	if contains(arg, ctx.targets) || contains(arg, ctx.deps) {
+		return location(arg)
+	}
+	return ctx.expand(arg)
+}
+
+var shellWord = regexp.MustCompile(`[^\s'"();|&<>` + "`" + `]+`)
+
+var relativePath = regexp.MustCompile(`^(\w[\w.-]*/)*\w[\w-]*\.\w+$|^\.\.?/`)
+
+// Shell commands run in the execution root rather than the directory of the dune file, so the words of the command
+// that name a dependency or target are replaced by their locations.
+// Other words that look like relative paths are collected, since they can't be found at build time.
+func (ctx *actionContext) relocate(cmd string) string {
+	return shellWord.ReplaceAllStringFunc(cmd, func(word string) string {
+		if strings.Contains(word, "%{") || strings.Contains(word, "$") {
+			return word
+		}
+		if contains(word, ctx.targets) || contains(word, ctx.deps) {
+			loc, err := location(word)
+			if err == nil {
+				return loc
+			}
+		} else if relativePath.MatchString(word) {
+			ctx.relative = appendUnique(ctx.relative, word)
+		}
+		return word
+	})
+}
+
+var shellSafe = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+func shellQuote(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+func actionStrings(node SexpNode) ([]string, error) {
+	l, err := node.List()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, el := range l {
+		s, err := el.String()
+		if err != nil {
+			return nil, fmt.Errorf("unsupported argument %#v", el)
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// Translate a Dune action to a shell command.
+func (ctx *actionContext) command(node SexpNode) (string, error) {
+	l, err := node.List()
+	if err != nil || len(l) == 0 {
+		return "", fmt.Errorf("invalid action %#v", node)
+	}
+	name, err := l[0].String()
+	if err != nil {
+		return "", fmt.Errorf("invalid action %#v", node)
+	}
+	args := l[1:]
+	switch name {
+	case "run":
+		strs, err := actionStrings(SexpList{args})
+		if err != nil {
+			return "", err
+		}
+		var words []string
+		for _, arg := range strs {
+			word, err := ctx.expandFile(arg)
+			if err != nil {
+				return "", err
+			}
+			if word == arg {
+				word = shellQuote(word)
+			}
+			words = append(words, word)
+		}
+		return strings.Join(words, " "), nil
+	case "with-stdout-to":
+		if len(args) != 2 {
+			return "", fmt.Errorf("invalid action %#v", node)
+		}
+		file, err := args[0].String()
+		if err != nil {
+			return "", fmt.Errorf("invalid action %#v", node)
+		}
+		out, err := ctx.expandFile(file)
+		if err != nil {
+			return "", err
+		}
+		cmd, err := ctx.command(args[1])
+		if err != nil {
+			return "", err
+		}
+		return cmd + " > " + out, nil
+	case "copy":
+		strs, err := actionStrings(SexpList{args})
+		if err != nil || len(strs) != 2 {
+			return "", fmt.Errorf("invalid action %#v", node)
+		}
+		if !duneVariable.MatchString(strs[0]) {
+			ctx.addDep(strs[0])
+		}
+		src, err := ctx.expandFile(strs[0])
+		if err != nil {
+			return "", err
+		}
+		dst, err := ctx.expandFile(strs[1])
+		if err != nil {
+			return "", err
+		}
+		return "cp " + src + " " + dst, nil
+	case "system", "bash":
+		if len(args) != 1 {
+			return "", fmt.Errorf("invalid action %#v", node)
+		}
+		cmd, err := args[0].String()
+		if err != nil {
+			return "", fmt.Errorf("invalid action %#v", node)
+		}
+		return ctx.expand(ctx.relocate(cmd))
+	default:
+		return "", fmt.Errorf("unsupported action %s", name)
+	}
+}
+
+// The action is either given in the `action` field or, in the short form of the stanza, as its only element, in which
+// case the map contains the action's arguments under its name.
+func ruleAction(dune SexpMap) (SexpNode, bool) {
+	if action, exists := dune.Values["action"]; exists {
+		if l, err := action.List(); err == nil && len(l) == 1 {
+			return l[0], true
+		}
+		return action, true
+	}
+	for _, name := range duneActions {
+		if args, exists := dune.Values[name]; exists {
+			l, _ := args.List()
+			return SexpList{append([]SexpNode{SexpString{name}}, l...)}, true
+		}
+	}
+	return nil, false
+}
+
+// Dependencies are either files or named files like `(:gen gen.ml)`.
+func ruleDeps(data SexpComponent, ctx *actionContext) error {
+	raw, exists := data.data.Values["deps"]
+	if !exists {
+		return nil
+	}
+	l, err := raw.List()
+	if err != nil {
+		return fmt.Errorf("invalid deps %#v", raw)
+	}
+	for _, dep := range l {
+		if file, err := dep.String(); err == nil {
+			ctx.addDep(file)
+		} else if named, err := actionStrings(dep); err == nil && len(named) == 2 && strings.HasPrefix(named[0], ":") {
+			ctx.named[strings.TrimPrefix(named[0], ":")] = named[1]
+			ctx.addDep(named[1])
+		} else {
+			return fmt.Errorf("unsupported dependency %#v", dep)
+		}
+	}
+	return nil
+}
+
+func decodeDuneRule(dune SexpMap) (DuneRule, error) {
+	data := SexpComponent{"rule", dune}
+	ctx := actionContext{named: make(map[string]string)}
+	action, exists := ruleAction(dune)
+	if !exists {
+		return DuneRule{}, fmt.Errorf("no supported action")
+	}
+	ctx.targets = data.strings("targets")
+	if _, hasTargets := dune.Values["targets"]; !hasTargets {
+		ctx.targets = data.strings("target")
+	}
+	if len(ctx.targets) == 0 {
+		// The target of the short form is inferred from `with-stdout-to` or `copy`
+		if l, err := action.List(); err == nil && len(l) == 3 {
+			var target SexpNode
+			if (l[0] == SexpString{"with-stdout-to"}) {
+				target = l[1]
+			} else if (l[0] == SexpString{"copy"}) {
+				target = l[2]
+			}
+			if file, err := target.String(); target != nil && err == nil {
+				ctx.targets = []string{file}
+			}
+		}
+	}
+	if len(ctx.targets) == 0 {
+		return DuneRule{}, fmt.Errorf("no targets")
+	}
+	if err := ruleDeps(data, &ctx); err != nil {
+		return DuneRule{}, err
+	}
+	cmd, err := ctx.command(action)
+	if err != nil {
+		return DuneRule{}, err
+	}
+	for _, tool := range ctx.tools {
+		log.Printf("WARNING: dune rule %s: %%{bin:%s} is looked up in the PATH of the build, which isn't hermetic", ctx.targets[0], tool)
+	}
+	for _, file := range ctx.relative {
+		log.Printf("WARNING: dune rule %s: the command runs in the execution root, where the relative path %s doesn't exist", ctx.targets[0], file)
+	}
+	for _, file := range ctx.targets {
+		if _, err := fileLabel(file); err != nil {
+			return DuneRule{}, err
+		}
+	}
+	var srcs []string
+	for _, file := range ctx.deps {
+		label, err := fileLabel(file)
+		if err != nil {
+			return DuneRule{}, err
+		}
+		srcs = append(srcs, label)
+	}
+	return DuneRule{targets: ctx.targets, srcs: srcs, cmd: cmd, enabledIf: decodeEnabledIf(data)}, nil
+}
+
+// Parse Dune `rule` stanzas.
+// Rules with actions that can't be translated are skipped with a warning.
+func decodeDuneRules(conf SexpList) []DuneRule {
+	var result []DuneRule
+	for _, node := range conf.Sub {
+		if dune, isMap := node.(SexpMap); isMap && dune.Name == "rule" {
+			r, err := decodeDuneRule(dune)
+			if err != nil {
+				log.Printf("Skipping dune rule: %s: %#v", err, dune)
+				continue
+			}
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// The modules created by the rules, mapped to whether an interface is generated as well.
+func ruleModules(rules []DuneRule) map[string]bool {
+	result := make(map[string]bool)
+	for _, r := range rules {
+		for _, target := range r.targets {
+			if path.Ext(target) == ".ml" && !strings.Contains(target, "/") {
+				name := extractDependencyname(target)
+				result[name] = contains(name+".mli", r.targets)
+			}
+		}
+	}
+	return result
+}
+
+func ruleModuleNames(rules []DuneRule) []string {
+	var result []string
+	for name := range ruleModules(rules) {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// The genrule is annotated with `# okapi:rule`, so that it is deleted when the stanza is removed from the Dune file.
+func genrule(r DuneRule, name string, conf *Config) RuleResult {
+	gen := rule.NewRule("genrule", name)
+	gen.AddComment("# okapi:rule")
+	extendAttr(gen, "srcs", r.srcs)
+	gen.SetAttr("outs", r.targets)
+	gen.SetAttr("cmd", r.cmd)
+	if r.enabledIf != nil {
+		compatibilityAttr(gen, r.enabledIf.constraints(conf))
+	}
+	return RuleResult{gen, nil}
+}
+
+// The package containing `file`, or false if it is outside of the repository.
+// Since `copy_files` is mostly used with sibling directories containing libraries, their build files are assumed to be
+// in the same directory as the files.
+func filePackage(repoRoot string, file string) (string, bool) {
+	rel, err := filepath.Rel(repoRoot, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	pkg := filepath.ToSlash(filepath.Dir(rel))
+	if pkg == "." {
+		pkg = ""
+	}
+	return pkg, true
+}
+
+// Files copied with `copy_files` by the package `pkg` are referred to by the filegroups that the packages containing
+// them create for `pkg`, see `copySources`, since source files aren't visible to other packages.
+func copyRule(repoRoot string, pkg string, files []string, naming Naming) (DuneRule, bool) {
+	var targets []string
+	var srcs []string
+	for _, file := range files {
+		src, inRepo := filePackage(repoRoot, file)
+		if !inRepo {
+			log.Printf("Skipping file %s copied from outside of the repository", file)
+			continue
+		}
+		targets = append(targets, filepath.Base(file))
+		srcs = appendUnique(srcs, label.New("", src, naming.copyTarget(pkg)).String())
+	}
+	if len(targets) == 0 {
+		return DuneRule{}, false
+	}
+	return DuneRule{targets: targets, srcs: srcs, cmd: "cp $(SRCS) $(RULEDIR)"}, true
+}
+
+// The filegroups exporting the files of the package `rel` to the packages that copy them with `copy_files`.
+// They are annotated with `# okapi:copy_files <package>`, so that they are deleted when the files aren't copied anymore.
+func copySources(rel string, conf *Config) []RuleResult {
+	var result []RuleResult
+	for _, cp := range conf.copies[rel] {
+		r := rule.NewRule("filegroup", conf.naming.copyTarget(cp.copier))
+		var srcs []string
+		for _, file := range cp.files {
+			srcs = append(srcs, ":"+file)
+		}
+		r.SetAttr("srcs", srcs)
+		r.SetAttr("visibility", []string{label.New("", cp.copier, "__pkg__").String()})
+		r.AddComment("# okapi:copy_files " + cp.copier)
+		result = append(result, RuleResult{r, nil})
+	}
+	return result
+}
+
+// The genrules are named after their first target, so rules whose first targets only differ in their extension, like
+// a rule stanza and the genrule of `copy_files`, get a numbered suffix.
+func genrules(rules []DuneRule, conf *Config) []RuleResult {
+	var result []RuleResult
+	used := make(map[string]bool)
+	for _, r := range rules {
+		base := conf.naming.ruleTarget(extractDependencyname(r.targets[0]))
+		name := base
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s_%d", base, i)
+		}
+		used[name] = true
+		result = append(result, genrule(r, name, conf))
+	}
+	return result
+}
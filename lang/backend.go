@@ -0,0 +1,234 @@
+package okapi
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// The rule set targeted by the generated build files.
+// `LegacyBackend` emits rules for the original OBazl API, `RulesOcamlBackend` for the current `rules_ocaml` API.
+// Both are fed the same `PackageSpec`, only the rule vocabulary differs.
+type Backend interface {
+	load() rule.LoadInfo
+	libraryKind(wrapped bool, ppx bool, library bool) string
+	moduleKind(ppx bool) string
+	executableKind(ppx bool, test bool) string
+	// The attribute of a library rule that lists its modules
+	modulesAttr(wrapped bool) string
+	ppxExecutable(target string, deps []string) *rule.Rule
+	// Attributes for a module that is preprocessed by the executable `ppx`, whose generated code uses the OPAM libraries
+	// `codeps`
+	ppxAttrs(r *rule.Rule, ppx string, codeps []string)
+	// The ppx libraries that have to be resolved as dependencies of preprocessed modules
+	ppxImports(deps []string) []string
+	// Add resolved OPAM dependencies to a rule
+	opamDeps(r *rule.Rule, deps []string)
+	// Link C libraries into an OCaml library
+	ccDeps(r *rule.Rule, labels []string)
+	// The config setting that matches builds in bytecode or native mode
+	modeCondition(byte bool) string
+	// The build setting holding the compilation mode, which the config settings of `modeCondition` match
+	modeSetting() string
+	// Attributes that earlier versions of Okapi generated, but that aren't supported by the backend's rules
+	obsoleteAttrs() []string
+}
+
+type LegacyBackend struct{}
+type RulesOcamlBackend struct{}
+
+func (LegacyBackend) load() rule.LoadInfo {
+	return rule.LoadInfo{
+		Name: "@obazl_rules_ocaml//ocaml:rules.bzl",
+		Symbols: []string{
+			"ocaml_ns_library",
+			"ocaml_library",
+			"ppx_ns_library",
+			"ppx_library",
+			"ocaml_ns_archive",
+			"ocaml_archive",
+			"ppx_ns_archive",
+			"ppx_archive",
+			"ocaml_module",
+			"ppx_module",
+			"ocaml_signature",
+			"ocaml_executable",
+			"ppx_executable",
+			"ocaml_test",
+			"ppx_test",
+			"ocaml_lex",
+		},
+		After: nil,
+	}
+}
+
+func (RulesOcamlBackend) load() rule.LoadInfo {
+	return rule.LoadInfo{
+		Name: "@rules_ocaml//build:rules.bzl",
+		Symbols: []string{
+			"ocaml_ns",
+			"ocaml_library",
+			"ocaml_ns_archive",
+			"ocaml_archive",
+			"ocaml_module",
+			"ocaml_signature",
+			"ocaml_executable",
+			"ppx_executable",
+			"ocaml_test",
+			"ocaml_lex",
+		},
+		After: nil,
+	}
+}
+
+func (LegacyBackend) libraryKind(wrapped bool, ppx bool, library bool) string {
+	prefix := "ocaml_"
+	if ppx {
+		prefix = "ppx_"
+	}
+	if wrapped {
+		prefix += "ns_"
+	}
+	return prefix + libSuffix(library)
+}
+
+// Preprocessing is configured on the modules, so there are no separate kinds for ppx libraries.
+func (RulesOcamlBackend) libraryKind(wrapped bool, ppx bool, library bool) string {
+	if wrapped && library {
+		return "ocaml_ns"
+	} else if wrapped {
+		return "ocaml_ns_archive"
+	} else {
+		return "ocaml_" + libSuffix(library)
+	}
+}
+
+func (LegacyBackend) moduleKind(ppx bool) string {
+	if ppx {
+		return "ppx_module"
+	} else {
+		return "ocaml_module"
+	}
+}
+
+func (RulesOcamlBackend) moduleKind(bool) string { return "ocaml_module" }
+
+func (LegacyBackend) executableKind(ppx bool, test bool) string {
+	prefix := "ocaml_"
+	if ppx {
+		prefix = "ppx_"
+	}
+	if test {
+		return prefix + "test"
+	} else {
+		return prefix + "executable"
+	}
+}
+
+func (RulesOcamlBackend) executableKind(ppx bool, test bool) string {
+	if test {
+		return "ocaml_test"
+	} else {
+		return "ocaml_executable"
+	}
+}
+
+func (LegacyBackend) modulesAttr(wrapped bool) string { return moduleAttr(wrapped) }
+
+func (RulesOcamlBackend) modulesAttr(bool) string { return "manifest" }
+
+func (LegacyBackend) ppxExecutable(target string, deps []string) *rule.Rule {
+	r := rule.NewRule("ppx_executable", target)
+	r.SetAttr("deps_opam", deps)
+	r.SetAttr("main", "@obazl_rules_ocaml//dsl:ppx_driver")
+	return r
+}
+
+func (RulesOcamlBackend) ppxExecutable(target string, deps []string) *rule.Rule {
+	r := rule.NewRule("ppx_executable", target)
+	r.SetAttr("deps", opamLabels(deps))
+	r.SetAttr("main", opamLabel("ppxlib.runner"))
+	return r
+}
+
+func (LegacyBackend) ppxAttrs(r *rule.Rule, ppx string, deps []string) {
+	r.SetAttr("ppx", ppx)
+	r.SetAttr("ppx_print", "@ppx//print:text")
+}
+
+// The runtime dependencies of the ppx libraries are passed as `ppx_codeps` instead of being resolved like regular
+// dependencies, while the rewriters themselves are only linked into the ppx executable.
+func (RulesOcamlBackend) ppxAttrs(r *rule.Rule, ppx string, codeps []string) {
+	r.SetAttr("ppx", ppx)
+	if len(codeps) > 0 {
+		r.SetAttr("ppx_codeps", opamLabels(codeps))
+	}
+}
+
+func (LegacyBackend) ppxImports(deps []string) []string { return deps }
+
+func (RulesOcamlBackend) ppxImports([]string) []string { return nil }
+
+func (LegacyBackend) opamDeps(r *rule.Rule, deps []string) { extendAttr(r, "deps_opam", deps) }
+
+func (RulesOcamlBackend) opamDeps(r *rule.Rule, deps []string) {
+	extendAttr(r, "deps", opamLabels(deps))
+}
+
+// OBazl's `cc_deps` maps each library to its link mode.
+func (LegacyBackend) ccDeps(r *rule.Rule, labels []string) {
+	modes := make(map[string]string)
+	for _, label := range labels {
+		modes[label] = "default"
+	}
+	r.SetAttr("cc_deps", modes)
+}
+
+func (RulesOcamlBackend) ccDeps(r *rule.Rule, labels []string) { extendAttr(r, "cc_deps", labels) }
+
+func (LegacyBackend) modeCondition(byte bool) string {
+	if byte {
+		return "@ocaml//mode:bytecode"
+	}
+	return "@ocaml//mode:native"
+}
+
+func (RulesOcamlBackend) modeCondition(byte bool) string {
+	if byte {
+		return "@rules_ocaml//cfg/mode:bytecode"
+	}
+	return "@rules_ocaml//cfg/mode:native"
+}
+
+func (LegacyBackend) modeSetting() string { return "@ocaml//mode" }
+
+func (RulesOcamlBackend) modeSetting() string { return "@rules_ocaml//cfg/mode" }
+
+func (LegacyBackend) obsoleteAttrs() []string { return nil }
+
+func (RulesOcamlBackend) obsoleteAttrs() []string { return []string{"ppx_print"} }
+
+// OPAM libraries are exposed as `@opam.<package>//lib`, sublibraries like `re.pcre` as `@opam.re//lib/pcre`.
+func opamLabel(dep string) string {
+	parts := strings.Split(dep, ".")
+	return "@opam." + parts[0] + "//" + strings.Join(append([]string{"lib"}, parts[1:]...), "/")
+}
+
+// The inverse of `opamLabel`.
+func opamName(l string) (string, bool) {
+	rex := regexp.MustCompile(`^@opam\.([^/]+)//lib((/[^/:]+)*)$`)
+	match := rex.FindStringSubmatch(l)
+	if len(match) < 3 {
+		return "", false
+	}
+	return match[1] + strings.ReplaceAll(match[2], "/", "."), true
+}
+
+func opamLabels(deps []string) []string {
+	var result []string
+	for _, dep := range deps {
+		result = append(result, opamLabel(dep))
+	}
+	return result
+}
@@ -0,0 +1,37 @@
+package okapi
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+func TestRulesOcamlBackend(t *testing.T) {
+	const duneFile = `
+(library
+ (name sub_lib)
+ (preprocess (pps ppx_inline_test))
+ (libraries re.pcre))
+`
+	spec := duneToSpec(decodeDuneConfig("test", parseDune(duneFile), defaultProject))
+	deps := Deps{"foo": Source{name: "foo", intf: false, virtual: false, deps: nil, generator: NoGenerator{}}}
+	conf := defaultConfig()
+	conf.library = true
+	conf.backend = RulesOcamlBackend{}
+	results := multilib(spec, deps, conf)
+	var kinds []string
+	for _, result := range results {
+		kinds = append(kinds, result.rule.Kind())
+	}
+	checkOutput(t, kinds, []string{"ppx_executable", "ocaml_module", "ocaml_ns"})
+	ppx, mod, lib := results[0].rule, results[1].rule, results[2].rule
+	checkOutput(t, ppx.AttrStrings("deps"), []string{"@opam.ppx_inline_test//lib"})
+	checkOutput(t, mod.AttrStrings("ppx_codeps"), []string{"@opam.ppx_inline_test//lib/runtime-lib"})
+	checkOutput(t, mod.Attr("ppx_print"), nil)
+	checkOutput(t, results[1].deps, []string{"re.pcre"})
+	checkOutput(t, lib.AttrStrings("manifest"), []string{":foo"})
+	checkOutput(t, opamLabel("re.pcre"), "@opam.re//lib/pcre")
+	f := rule.EmptyFile("BUILD.bazel", "")
+	conf.directive(f, "", rule.Directive{Key: ppxCodepsDirective, Value: "ppx_custom custom.runtime"})
+	checkOutput(t, conf.ppxCodeps([]string{"ppx_custom", "ppx_sexp_conv"}), []string{"custom.runtime", "sexplib0"})
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -36,13 +37,40 @@ type Choice struct {
 	alts []ModuleAlt
 }
 
+// A parser generated from a `.mly` grammar by menhir, which creates both a module and a signature.
+type Menhir struct {
+	flags []string
+}
+
+// A parser generated from a `.mly` grammar by ocamlyacc.
+type Ocamlyacc struct{}
+
+// A module copied from another directory with `copy_files`, given by the absolute paths of its source files.
+type Copy struct {
+	ml  string
+	mli string
+}
+
+// A module created by a Dune `rule` stanza, which may generate its interface as well.
+type RuleTarget struct {
+	intf bool
+}
+
 func (NoGenerator) remove() bool { return false }
 func (Lexer) remove() bool       { return true }
 func (Choice) remove() bool      { return false }
+func (Menhir) remove() bool      { return true }
+func (Ocamlyacc) remove() bool   { return true }
+func (RuleTarget) remove() bool  { return true }
+func (Copy) remove() bool        { return false }
 
 func (NoGenerator) libraryModule() bool { return true }
 func (Lexer) libraryModule() bool       { return false }
 func (Choice) libraryModule() bool      { return true }
+func (Menhir) libraryModule() bool      { return true }
+func (Ocamlyacc) libraryModule() bool   { return true }
+func (RuleTarget) libraryModule() bool  { return true }
+func (Copy) libraryModule() bool        { return true }
 
 type CodeptSource struct {
 	name       string
@@ -58,6 +86,13 @@ type Source struct {
 	virtual   bool
 	deps      []string
 	generator Generator
+	// The subdirectory containing the source, relative to the package, if it was included with `include_subdirs`
+	dir string
+}
+
+// The label of the source file with extension `ext`.
+func (src Source) file(ext string) string {
+	return ":" + path.Join(src.dir, src.name+ext)
 }
 
 type SourceSlice []Source
@@ -74,7 +109,7 @@ func extractDependencyname(file string) string {
 }
 
 // TODO remove intf from deps?
-func consSource(name string, intfs map[string][]string, deps []string, codept CodeptSource) Source {
+func consSource(name string, intfs map[string][]string, deps []string, codept CodeptSource, dir string) Source {
 	intf, hasIntf := intfs[name]
 	return Source{
 		name:      name,
@@ -82,6 +117,7 @@ func consSource(name string, intfs map[string][]string, deps []string, codept Co
 		virtual:   false,
 		deps:      append(deps, intf...),
 		generator: codept.generator,
+		dir:       dir,
 	}
 }
 
@@ -102,7 +138,119 @@ func runLexer(dir string, file string) string {
 	return mlpath
 }
 
-func prepareSources(dir string, files []string) map[string]CodeptSource {
+// Menhir writes the parser next to the grammar, like `runLexer`.
+// Other files that are created due to flags like `--explain` are removed right away.
+func runMenhir(dir string, file string, flags []string) (string, string) {
+	base := filepath.Join(dir, strings.TrimSuffix(file, ".mly"))
+	path := filepath.Join(dir, file)
+	ml := base + ".ml"
+	mli := base + ".mli"
+	for _, out := range []string{ml, mli} {
+		if _, err := os.Stat(out); err == nil {
+			log.Fatalf("menhir output %s for %s already exists.", out, path)
+		}
+	}
+	args := append(append([]string{}, flags...), "--base", base, path)
+	cmd := exec.Command("menhir", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Fatalf("menhir failed for %s with %#v: %s\n", path, err.Error(), string(out))
+	}
+	for _, ext := range []string{".conflicts", ".automaton", ".cmly"} {
+		os.Remove(base + ext)
+	}
+	return ml, mli
+}
+
+func runOcamlyacc(dir string, file string) (string, string) {
+	base := filepath.Join(dir, strings.TrimSuffix(file, ".mly"))
+	path := filepath.Join(dir, file)
+	ml := base + ".ml"
+	mli := base + ".mli"
+	for _, out := range []string{ml, mli} {
+		if _, err := os.Stat(out); err == nil {
+			log.Fatalf("ocamlyacc output %s for %s already exists.", out, path)
+		}
+	}
+	cmd := exec.Command("ocamlyacc", path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Fatalf("ocamlyacc failed for %s with %#v: %s\n", path, err.Error(), string(out))
+	}
+	return ml, mli
+}
+
+// The generator for a grammar, which has to be declared in the dune file.
+// Without a dune file, `generators` is nil and grammars are processed by ocamlyacc, like lexers by ocamllex.
+func grammarGenerator(name string, generators map[string]Generator) (Generator, bool) {
+	if generators == nil {
+		return Ocamlyacc{}, true
+	}
+	gen, exists := generators[name]
+	return gen, exists
+}
+
+// The sources generated by Dune rules can't be created without building their dependencies, so empty files are used
+// in their place.
+// This way, codept recognizes them as local modules, though their own dependencies are unknown.
+func ruleStubs(dir string, generators map[string]Generator, result map[string]CodeptSource) {
+	for name, gen := range generators {
+		target, isRuleTarget := gen.(RuleTarget)
+		if !isRuleTarget {
+			continue
+		}
+		exts := []string{".ml"}
+		if target.intf {
+			exts = append(exts, ".mli")
+		}
+		for _, ext := range exts {
+			if _, exists := result[name+ext]; exists {
+				continue
+			}
+			path := filepath.Join(dir, name+ext)
+			if _, err := os.Stat(path); err == nil {
+				log.Fatalf("Source %s, which is generated by a dune rule, already exists.", path)
+			}
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				log.Fatalf("Creating a placeholder for %s, which is generated by a dune rule: %s", path, err)
+			}
+			result[name+ext] = CodeptSource{
+				name:       name,
+				ext:        ext,
+				path:       path,
+				codeptPath: path,
+				generator:  target,
+			}
+		}
+	}
+}
+
+// Files copied from other directories with `copy_files` are passed to codept at their original location, but stored
+// under the name of the copy in the package.
+func copiedSources(generators map[string]Generator, result map[string]CodeptSource) {
+	for name, gen := range generators {
+		cp, isCopy := gen.(Copy)
+		if !isCopy {
+			continue
+		}
+		for _, file := range []string{cp.ml, cp.mli} {
+			key := name + filepath.Ext(file)
+			if _, exists := result[key]; file == "" || exists {
+				continue
+			}
+			result[key] = CodeptSource{
+				name:       name,
+				ext:        filepath.Ext(file),
+				path:       file,
+				codeptPath: file,
+				generator:  cp,
+			}
+		}
+	}
+}
+
+// Grammars are only processed if the dune file declares a generator for them in `generators`.
+func prepareSources(dir string, files []string, generators map[string]Generator) map[string]CodeptSource {
 	result := make(map[string]CodeptSource)
 	for _, file := range files {
 		path := filepath.Join(dir, file)
@@ -118,55 +266,131 @@ func prepareSources(dir string, files []string) map[string]CodeptSource {
 			}
 		} else if ext == ".mll" {
 			ml := runLexer(dir, file)
-			result[name+".ml"] = CodeptSource{
+			result[filepath.Join(filepath.Dir(file), name+".ml")] = CodeptSource{
 				name:       name,
 				ext:        ext,
 				path:       path,
 				codeptPath: ml,
 				generator:  Lexer{},
 			}
+		} else if ext == ".mly" {
+			gen, exists := grammarGenerator(name, generators)
+			if !exists {
+				continue
+			}
+			var ml, mli string
+			if menhir, isMenhir := gen.(Menhir); isMenhir {
+				ml, mli = runMenhir(dir, file, menhir.flags)
+			} else {
+				ml, mli = runOcamlyacc(dir, file)
+			}
+			for _, out := range []string{ml, mli} {
+				result[filepath.Join(filepath.Dir(file), name+filepath.Ext(out))] = CodeptSource{
+					name:       name,
+					ext:        ext,
+					path:       path,
+					codeptPath: out,
+					generator:  gen,
+				}
+			}
 		}
 	}
+	ruleStubs(dir, generators, result)
+	copiedSources(generators, result)
 	return result
 }
 
+// The path of a source file relative to the package directory, if the file is located in it or in a subdirectory.
+func packagePath(dir string, file string) (string, bool) {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// Sources in subdirectories included with `(include_subdirs qualified)` are referred to by a module path containing the
+// capitalized directory names, like `Sub.Foo` for `sub/foo.ml`.
+// Since codept is run on a flat list of files, these paths are added as aliases of the module.
+func qualifiedPaths(module []string, rel string) []string {
+	subdir := filepath.Dir(rel)
+	if subdir == "." || len(module) == 0 {
+		return nil
+	}
+	var segments []string
+	for _, segment := range strings.Split(subdir, "/") {
+		segments = append(segments, strings.Title(segment))
+	}
+	qualified := append(segments, module[len(module)-1])
+	prefix := append([]string{}, module[:len(module)-1]...)
+	return []string{modulePath(qualified), modulePath(append(prefix, qualified...))}
+}
+
 // The `local` key in the codept output maps all used modules to their defining source files with the structure
 // { "module": ["Qualified", "Module", "Name"], "ml": "/path/to/name.ml" }.
 // THe `dependencies` key maps each input file to the set of modules they use, with the structure
 // { "file": "/path/to/name.ml", deps: [["Qualified", "Module", "Name"], ["List"]] }.
 // This function maps the files from `dependencies` to the files from `local`, noting whether a signature exists for
 // each module.
+// Files in subdirectories are only present if they were included with `include_subdirs`, in which case module names
+// have to be unique across the directories.
 func consDeps(dir string, codept Codept, codeptSources map[string]CodeptSource) Deps {
 	local := make(map[string]string)
 	intfs := make(map[string][]string)
 	mods := make(map[string][]string)
+	files := make(map[string]string)
 	sources := make(Deps)
 	for _, loc := range codept.Local {
 		src := loc.Ml
 		if src == "" {
 			src = loc.Mli
 		}
-		local[modulePath(loc.Module)] = extractDependencyname(src)
+		name := extractDependencyname(src)
+		local[modulePath(loc.Module)] = name
+		if rel, inPackage := packagePath(dir, src); inPackage {
+			for _, alias := range qualifiedPaths(loc.Module, rel) {
+				local[alias] = name
+			}
+		}
+	}
+	copies := make(map[string]string)
+	for key, src := range codeptSources {
+		if _, isCopy := src.generator.(Copy); isCopy {
+			copies[src.codeptPath] = key
+		}
 	}
 	for _, src := range codept.Dependencies {
-		if filepath.Dir(src.File) == dir {
-			var deps []string
-			for _, ds := range src.Deps {
-				dep := local[modulePath(ds)]
-				if dep != "" {
-					deps = append(deps, dep)
-				}
+		rel, inPackage := packagePath(dir, src.File)
+		if copied, isCopy := copies[src.File]; isCopy {
+			rel, inPackage = copied, true
+		}
+		if !inPackage {
+			continue
+		}
+		var deps []string
+		for _, ds := range src.Deps {
+			dep := local[modulePath(ds)]
+			if dep != "" {
+				deps = append(deps, dep)
 			}
-			name := extractDependencyname(src.File)
-			if filepath.Ext(src.File) == ".mli" {
-				intfs[name] = deps
-			} else {
-				mods[name] = deps
+		}
+		name := extractDependencyname(src.File)
+		if other, exists := files[name]; exists && filepath.Dir(other) != filepath.Dir(rel) {
+			log.Fatalf("Module %s is defined in both %s and %s.", name, other, rel)
+		}
+		if filepath.Ext(src.File) == ".mli" {
+			intfs[name] = deps
+			if _, exists := files[name]; !exists {
+				files[name] = rel
 			}
+		} else {
+			mods[name] = deps
+			files[name] = rel
 		}
 	}
 	for src, deps := range mods {
-		sources[src] = consSource(src, intfs, deps, codeptSources[src+".ml"])
+		subdir := filepath.Dir(files[src])
+		sources[src] = consSource(src, intfs, deps, codeptSources[files[src]], sourceDir(subdir))
 	}
 	for src, deps := range intfs {
 		if _, mod := mods[src]; !mod {
@@ -176,12 +400,20 @@ func consDeps(dir string, codept Codept, codeptSources map[string]CodeptSource)
 				virtual:   true,
 				deps:      deps,
 				generator: NoGenerator{},
+				dir:       sourceDir(filepath.Dir(files[src])),
 			}
 		}
 	}
 	return sources
 }
 
+func sourceDir(subdir string) string {
+	if subdir == "." {
+		return ""
+	}
+	return filepath.ToSlash(subdir)
+}
+
 // While codept is able to scan a directory, there's no way to exclude subdirectories, so files have to be specified
 // explicitly.
 // In some cases, for example when the module `Stdlib.List` is used, codept will list modules without prefix (e.g.
@@ -253,8 +485,8 @@ func runCodept(dir string, sources map[string]CodeptSource) []byte {
 //     "mli" : "/home/sir4ur0n/code/qcheck/src/core/QCheck2.mli"
 //     }]
 //   }
-func Dependencies(dir string, files []string) Deps {
-	sources := prepareSources(dir, files)
+func Dependencies(dir string, files []string, generators map[string]Generator) Deps {
+	sources := prepareSources(dir, files, generators)
 	out := runCodept(dir, sources)
 	var codept Codept
 	err := json.Unmarshal(out, &codept)
@@ -0,0 +1,49 @@
+package okapi
+
+import "testing"
+
+func TestConsDepsSubdirs(t *testing.T) {
+	codept := Codept{
+		Dependencies: []CodeptDep{
+			{File: "/pkg/a.ml", Deps: [][]string{{"Okapi", "Sub", "Foo"}, {"List"}}},
+			{File: "/pkg/sub/foo.ml", Deps: nil},
+			{File: "/pkg/sub/foo.mli", Deps: nil},
+		},
+		Local: []CodeptLocal{
+			{Module: []string{"Okapi", "A"}, Ml: "/pkg/a.ml"},
+			{Module: []string{"Okapi", "Foo"}, Ml: "/pkg/sub/foo.ml", Mli: "/pkg/sub/foo.mli"},
+		},
+	}
+	sources := map[string]CodeptSource{
+		"a.ml":       {generator: NoGenerator{}},
+		"sub/foo.ml": {generator: NoGenerator{}},
+	}
+	deps := consDeps("/pkg", codept, sources)
+	checkOutput(t, deps["a"].deps, []string{"foo"})
+	checkOutput(t, deps["a"].dir, "")
+	checkOutput(t, deps["foo"].dir, "sub")
+	checkOutput(t, deps["foo"].intf, true)
+}
+
+func TestConsDepsCopies(t *testing.T) {
+	codept := Codept{
+		Dependencies: []CodeptDep{
+			{File: "/app/main.ml", Deps: [][]string{{"Okapi", "Util"}}},
+			{File: "/common/util.ml", Deps: nil},
+			{File: "/common/util.mli", Deps: nil},
+		},
+		Local: []CodeptLocal{
+			{Module: []string{"Okapi", "Main"}, Ml: "/app/main.ml"},
+			{Module: []string{"Okapi", "Util"}, Ml: "/common/util.ml", Mli: "/common/util.mli"},
+		},
+	}
+	cp := Copy{ml: "/common/util.ml", mli: "/common/util.mli"}
+	sources := make(map[string]CodeptSource)
+	copiedSources(map[string]Generator{"util": cp}, sources)
+	sources["main.ml"] = CodeptSource{generator: NoGenerator{}}
+	deps := consDeps("/app", codept, sources)
+	checkOutput(t, deps["main"].deps, []string{"util"})
+	checkOutput(t, deps["util"].generator, Generator(cp))
+	checkOutput(t, deps["util"].intf, true)
+	checkOutput(t, deps["util"].dir, "")
+}
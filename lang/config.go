@@ -0,0 +1,223 @@
+package okapi
+
+import (
+	"flag"
+	"log"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// Settings for a single directory.
+// The root config is populated from the command line flags, and each directory inherits its parent's config, which
+// can then be amended with `# gazelle:okapi_*` directives in the directory's build file.
+type Config struct {
+	// Whether to generate `*_library` rules instead of `*_archive` rules
+	library bool
+	// The rule set to generate, determined by the language variant that was loaded into Gazelle
+	backend Backend
+	// Depspecs from `libraries` mapped to a manually chosen resolution, as `ResolvedLocal` or `ResolvedOpam`
+	resolves map[string]interface{}
+	// Patterns for the names of generated targets
+	naming Naming
+	// The runtime libraries of ppx rewriters, which are used by the code they generate
+	ppxRuntime map[string][]string
+	// The mode of a Dune `include_subdirs` stanza in this directory or one of its parents, or empty
+	includeSubdirs string
+	// The directory containing the `include_subdirs` stanza, which owns the sources of its subdirectories
+	includeRoot string
+	// The root of the repository, used to create labels for files copied from other packages
+	repoRoot string
+	// The files of each package that are copied by other packages, which are found when configuring the root
+	copies map[string][]CopiedFiles
+	// The version of the OCaml compiler, which replaces `%{ocaml_version}` in `enabled_if` and preprocessing actions
+	ocamlVersion string
+	// The settings of the closest `dune-project` in this directory or one of its parents
+	project DuneProject
+	// The value of `:standard` in the flags of stanzas and the topmost `env` stanza
+	standardFlags []string
+	// The profiles from the `env` stanzas in this directory and its parents
+	env Env
+	// The subdirectories of this directory that Dune builds
+	subdirs Subdirs
+	// Whether Dune ignores this directory, because of `dirs` or `data_only_dirs` in a parent directory
+	excluded bool
+	// Whether this directory is below one of the `vendored_dirs` of a parent directory
+	vendored bool
+}
+
+const (
+	// `# gazelle:okapi_library [true|false]`
+	libraryDirective = "okapi_library"
+	// `# gazelle:okapi_archive [true|false]`
+	archiveDirective = "okapi_archive"
+	// `# gazelle:okapi_resolve depspec label-or-opam-name`
+	resolveDirective = "okapi_resolve"
+	// `# gazelle:okapi_naming library|namespace|executable|signature|lexer|parser|rule|stubs|inline_tests|ppx|profile|copy pattern`
+	namingDirective = "okapi_naming"
+	// `# gazelle:okapi_ocaml_version version`
+	ocamlVersionDirective = "okapi_ocaml_version"
+	// `# gazelle:okapi_ppx_codeps rewriter library...`
+	ppxCodepsDirective = "okapi_ppx_codeps"
+	// `# gazelle:okapi_standard_flags flags...`
+	standardFlagsDirective = "okapi_standard_flags"
+)
+
+var directives = []string{
+	libraryDirective,
+	archiveDirective,
+	resolveDirective,
+	namingDirective,
+	ocamlVersionDirective,
+	standardFlagsDirective,
+	ppxCodepsDirective,
+}
+
+func getConfig(c *config.Config) *Config {
+	conf, valid := c.Exts[okapiName].(*Config)
+	if !valid {
+		log.Fatalf("invalid config: %#v", c.Exts[okapiName])
+	}
+	return conf
+}
+
+// Whether the sources in `rel` belong to a library in a parent directory.
+func (conf *Config) included(rel string) bool {
+	return conf.includeSubdirs != "" && rel != conf.includeRoot
+}
+
+func (conf *Config) clone() *Config {
+	result := *conf
+	result.resolves = make(map[string]interface{})
+	for dep, resolved := range conf.resolves {
+		result.resolves[dep] = resolved
+	}
+	result.ppxRuntime = make(map[string][]string)
+	for rewriter, libs := range conf.ppxRuntime {
+		result.ppxRuntime[rewriter] = libs
+	}
+	return &result
+}
+
+func defaultConfig() *Config {
+	conf := &Config{backend: LegacyBackend{}, naming: defaultNaming, project: defaultProject, ppxRuntime: defaultPpxRuntime}
+	return conf.clone()
+}
+
+func registerFlags(fs *flag.FlagSet, c *config.Config, backend Backend) {
+	conf := defaultConfig()
+	conf.backend = backend
+	fs.BoolVar(&conf.library, "library", false, "build libraries instead of archives")
+	c.Exts[okapiName] = conf
+}
+
+// A directive without a value is interpreted as `true`.
+func directiveBool(f *rule.File, d rule.Directive) bool {
+	if d.Value == "" {
+		return true
+	}
+	value, err := strconv.ParseBool(d.Value)
+	if err != nil {
+		log.Fatalf("%s: invalid value for `%s`: %s", f.Path, d.Key, d.Value)
+	}
+	return value
+}
+
+func isLabel(s string) bool {
+	return strings.HasPrefix(s, "//") || strings.HasPrefix(s, "@") || strings.HasPrefix(s, ":")
+}
+
+// `label.Parse` rejects `#`, which is used in the names of namespaced libraries.
+func parseLabel(s string) (label.Label, error) {
+	const escape = "__okapi_hash__"
+	l, err := label.Parse(strings.ReplaceAll(s, "#", escape))
+	l.Name = strings.ReplaceAll(l.Name, escape, "#")
+	return l, err
+}
+
+// Labels are recognized by their prefix, relative labels are interpreted relative to the build file's package.
+// Anything else is used verbatim as the name of an OPAM dependency.
+func directiveResolve(f *rule.File, rel string, d rule.Directive) (string, interface{}) {
+	parts := strings.Fields(d.Value)
+	if len(parts) != 2 {
+		log.Fatalf("%s: invalid `%s` directive, expected `depspec label`: %s", f.Path, d.Key, d.Value)
+	}
+	dep, target := parts[0], parts[1]
+	if isLabel(target) {
+		l, err := parseLabel(target)
+		if err != nil {
+			log.Fatalf("%s: invalid label in `%s` directive: %s", f.Path, d.Key, err)
+		}
+		return dep, ResolvedLocal{l.Abs("", rel)}
+	}
+	return dep, ResolvedOpam{target}
+}
+
+func (conf *Config) directive(f *rule.File, rel string, d rule.Directive) {
+	switch d.Key {
+	case libraryDirective:
+		conf.library = directiveBool(f, d)
+	case archiveDirective:
+		conf.library = !directiveBool(f, d)
+	case resolveDirective:
+		dep, resolved := directiveResolve(f, rel, d)
+		conf.resolves[dep] = resolved
+	case namingDirective:
+		conf.naming.directive(f, d)
+	case ocamlVersionDirective:
+		conf.ocamlVersion = d.Value
+	case standardFlagsDirective:
+		conf.standardFlags = strings.Fields(d.Value)
+	case ppxCodepsDirective:
+		parts := strings.Fields(d.Value)
+		if len(parts) == 0 {
+			log.Fatalf("%s: invalid `%s` directive, expected `rewriter library...`: %s", f.Path, d.Key, d.Value)
+		}
+		conf.ppxRuntime[parts[0]] = parts[1:]
+	}
+}
+
+// Copy the parent directory's config and apply the directives from the build file in `rel`, if there is one.
+// Settings from the directory's dune file that affect subdirectories are read here as well, and applied to the
+// subdirectories when they are configured.
+func configure(c *config.Config, rel string, f *rule.File) {
+	var conf *Config
+	if parent, exists := c.Exts[okapiName].(*Config); exists {
+		conf = parent.clone()
+	} else {
+		conf = defaultConfig()
+	}
+	if f != nil {
+		for _, d := range f.Directives {
+			conf.directive(f, rel, d)
+		}
+	}
+	conf.repoRoot = c.RepoRoot
+	if rel == "" && c.RepoRoot != "" {
+		conf.copies = scanCopiedFiles(c.RepoRoot)
+	}
+	if rel != "" {
+		conf.excluded = conf.excluded || conf.subdirs.excludes(path.Base(rel))
+		conf.vendored = conf.vendored || conf.subdirs.vendors(path.Base(rel))
+	}
+	conf.subdirs = Subdirs{}
+	if project, exists := readDuneProject(filepath.Join(c.RepoRoot, rel)); exists {
+		conf.project = project
+	}
+	if dune, exists := readDune(filepath.Join(c.RepoRoot, rel)); exists {
+		if mode := decodeIncludeSubdirs(dune); mode != "" {
+			conf.includeSubdirs = mode
+			conf.includeRoot = rel
+		}
+		conf.subdirs = decodeSubdirs(dune)
+		if env, exists := decodeEnv(dune); exists {
+			conf.env = conf.env.extend(env, rel, conf.naming, conf.standardFlags)
+		}
+	}
+	c.Exts[okapiName] = conf
+}
@@ -0,0 +1,242 @@
+package okapi
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/language"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+func configureData(t *testing.T, c *config.Config, rel string, data string) *Config {
+	f, err := rule.LoadData(rel+"/BUILD.bazel", rel, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(c, rel, f)
+	return getConfig(c)
+}
+
+func TestConfigDirectives(t *testing.T) {
+	root := config.New()
+	root.Exts[okapiName] = &Config{library: true}
+	configure(root, "", nil)
+	if !getConfig(root).library {
+		t.Fatalf("root config didn't inherit the flag value")
+	}
+	sub := root.Clone()
+	if configureData(t, sub, "sub", "# gazelle:okapi_archive\n").library {
+		t.Fatalf("`okapi_archive` wasn't applied")
+	}
+	nested := sub.Clone()
+	if configureData(t, nested, "sub/nested", "").library {
+		t.Fatalf("`okapi_archive` wasn't inherited")
+	}
+	if !configureData(t, nested.Clone(), "sub/nested/lib", "# gazelle:okapi_library true\n").library {
+		t.Fatalf("`okapi_library` wasn't applied")
+	}
+	if !getConfig(root).library {
+		t.Fatalf("subdirectory directives changed the root config")
+	}
+}
+
+func TestConfigResolve(t *testing.T) {
+	root := config.New()
+	configure(root, "", nil)
+	sub := root.Clone()
+	configureData(t, sub, "sub", `
+# gazelle:okapi_resolve acme.missiles //vendor/acme:#Missiles
+# gazelle:okapi_resolve re.pcre :pcre
+# gazelle:okapi_resolve renamed upstream-name
+`)
+	checkOutput(t, resolveDep(sub, nil, "acme.missiles"), ResolvedLocal{label.New("", "vendor/acme", "#Missiles")})
+	checkOutput(t, resolveDep(sub, nil, "re.pcre"), ResolvedLocal{label.New("", "sub", "pcre")})
+	checkOutput(t, resolveDep(sub, nil, "renamed"), ResolvedOpam{"upstream-name"})
+	if len(getConfig(root).resolves) != 0 {
+		t.Fatalf("subdirectory directives changed the root config")
+	}
+}
+
+func TestConfigNaming(t *testing.T) {
+	c := config.New()
+	configure(c, "", nil)
+	conf := configureData(t, c, "sub", `
+# gazelle:okapi_naming namespace {Name}_ns
+# gazelle:okapi_naming signature {name}_mli
+# gazelle:okapi_naming ppx {name}_driver
+`)
+	sources := Deps{
+		"bar":     src("bar", false),
+		"foo":     src("foo", true, "bar"),
+		"sub":     src("sub", false),
+		"choice1": src("choice1", false),
+		"choice2": src("choice2", false),
+	}
+	spec := duneToSpec(decodeDuneConfig("sub", parseDune(duneFile), defaultProject))
+	f := buildFile(t, multilib(spec, sources, conf))
+	results := AmendRules(f.Rules, sources, "", conf)
+	for _, name := range []string{"Sub_lib_ns", "Sub_extra_lib_ns", "foo_mli"} {
+		findResult(t, results, name)
+	}
+	foo := findResult(t, results, "foo").rule
+	checkOutput(t, foo.AttrString("sig"), ":foo_mli")
+	checkOutput(t, foo.AttrString("ppx"), ":set-1_driver")
+	var gen []*rule.Rule
+	for _, result := range results {
+		gen = append(gen, result.rule)
+	}
+	if stale := staleRules(f, gen, conf.naming); len(stale) != 0 {
+		t.Fatalf("unchanged build file has stale rules: %#v", stale)
+	}
+	target := conf.naming.libraryTarget("foo_bar.baz-qux", true)
+	checkOutput(t, target, "Foo_bar.baz_qux_ns")
+	name, matched := conf.naming.libraryName(target)
+	checkOutput(t, matched, true)
+	checkOutput(t, name, "foo_bar.baz_qux")
+}
+
+func TestReExport(t *testing.T) {
+	dune := parseDune("(library (name a) (libraries (re_export b) fmt))")
+	spec := duneToSpec(decodeDuneConfig("a", dune, defaultProject))
+	checkOutput(t, spec.modules[0].depsOpam, []string{"b", "fmt"})
+	checkOutput(t, spec.modules[0].kind.(LibSpec).reExports, []string{"b"})
+	c := config.New()
+	configure(c, "", nil)
+	lang := NewLanguage().(*okapiLang)
+	ix := resolve.NewRuleIndex(func(*rule.Rule, string) resolve.Resolver { return lang })
+	library := func(pkg string, name string, reExports string) {
+		f := rule.EmptyFile(pkg+"/BUILD.bazel", pkg)
+		r := rule.NewRule("ocaml_ns_archive", "#"+strings.Title(name))
+		r.AddComment("# okapi:public_name " + name)
+		if reExports != "" {
+			r.AddComment("# okapi:re_export " + reExports)
+		}
+		r.Insert(f)
+		ix.AddRule(c, r, f)
+	}
+	library("a", "a", "b")
+	library("b", "b", "c zarith")
+	library("c", "c", "a")
+	ix.Finish()
+	resolveUser := func() *rule.Rule {
+		r := rule.NewRule("ocaml_module", "user")
+		lang.Resolve(c, ix, nil, r, []string{"a"}, label.New("", "user", "user"))
+		return r
+	}
+	r := resolveUser()
+	checkOutput(t, r.AttrStrings("deps"), []string{"//a:#A"})
+	checkOutput(t, r.Attr("deps_opam"), nil)
+	getConfig(c).project.implicitTransitiveDeps = false
+	r = resolveUser()
+	checkOutput(t, r.AttrStrings("deps"), []string{"//a:#A", "//b:#B", "//c:#C"})
+	checkOutput(t, r.AttrStrings("deps_opam"), []string{"zarith"})
+}
+
+func TestDefaultImplementation(t *testing.T) {
+	root := t.TempDir()
+	c := config.New()
+	configure(c, "", nil)
+	lang := NewLanguage().(*okapiLang)
+	ix := resolve.NewRuleIndex(func(*rule.Rule, string) resolve.Resolver { return lang })
+	library := func(name string, dune string, sources Deps) {
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "dune"), []byte(dune), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := rule.EmptyFile(name+"/BUILD.bazel", name)
+		for _, result := range GenerateRules(dir, sources, filepath.Join(dir, "dune"), getConfig(c)) {
+			result.rule.Insert(f)
+		}
+		// The libraries are indexed from the formatted build file, like when they were generated in an earlier run
+		loaded, err := rule.LoadData(name+"/BUILD.bazel", name, f.Format())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range loaded.Rules {
+			ix.AddRule(c, r, loaded)
+		}
+	}
+	virtual := Source{name: "v", virtual: true, generator: NoGenerator{}}
+	library("virt", "(library (name virt) (virtual_modules v) (default_implementation impl1))", Deps{"v": virtual})
+	library("impl1", "(library (name impl1) (implements virt) (libraries log))", Deps{"v": src("v", false)})
+	library("impl2", "(library (name impl2) (implements virt))", Deps{"v": src("v", false)})
+	library("dep", "(library (name dep) (libraries virt fmt))", Deps{"d": src("d", false)})
+	library("log", "(library (name log) (virtual_modules l) (default_implementation log_stderr))", Deps{
+		"l": {name: "l", virtual: true, generator: NoGenerator{}},
+	})
+	library("log_stderr", "(library (name log_stderr) (implements log))", Deps{"l": src("l", false)})
+	ix.Finish()
+	checkOutput(t, lang.libraries["//dep:#Dep"].deps, []string{"virt", "fmt"})
+	checkOutput(t, lang.libraries["//virt:#Virt"].defaultImpl, "impl1")
+	exe := func(deps ...string) []string {
+		r := rule.NewRule("ocaml_executable", "exe")
+		lang.Resolve(c, ix, nil, r, deps, label.New("", "exe", "exe"))
+		return r.AttrStrings("deps")
+	}
+	checkOutput(t, exe("dep"), []string{"//impl1:#Impl1", "//log_stderr:#Log_stderr"})
+	checkOutput(t, exe("dep", "impl2"), []string{"//impl2:#Impl2"})
+	checkOutput(t, exe("dep", "//impl2:#Impl2"), []string{"//impl2:#Impl2"})
+	checkOutput(t, exe("fmt"), []string(nil))
+	var warnings bytes.Buffer
+	log.SetOutput(&warnings)
+	deps := exe("dep", "impl1", "impl2")
+	log.SetOutput(os.Stderr)
+	checkOutput(t, deps, []string(nil))
+	if !strings.Contains(warnings.String(), "several implementations of //virt:#Virt") {
+		t.Fatalf("expected a warning about the implementations of virt, got %q", warnings.String())
+	}
+}
+
+func TestConfigDirs(t *testing.T) {
+	root := config.New()
+	root.RepoRoot = t.TempDir()
+	dune := "(dirs (:standard \\ bench))\n(data_only_dirs fixtures)\n(vendored_dirs vendor)"
+	if err := os.WriteFile(filepath.Join(root.RepoRoot, "dune"), []byte(dune), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configure(root, "", nil)
+	for _, dir := range []string{"bench", "fixtures", "_opam", "vendor", "src"} {
+		sub := root.Clone()
+		configure(sub, dir, nil)
+		conf := getConfig(sub)
+		checkOutput(t, conf.excluded, dir == "bench" || dir == "fixtures" || dir == "_opam")
+		checkOutput(t, conf.vendored, dir == "vendor")
+		nested := sub.Clone()
+		configure(nested, dir+"/lib", nil)
+		checkOutput(t, getConfig(nested).excluded, conf.excluded)
+		checkOutput(t, getConfig(nested).vendored, conf.vendored)
+	}
+	vendored := root.Clone()
+	configure(vendored, "vendor", nil)
+	results := GenerateRulesAuto("vendor", Deps{"a": src("a", false)}, getConfig(vendored))
+	checkOutput(t, findResult(t, results, "a").rule.AttrStrings("opts"), []string{"-w", "-a"})
+	amended := AmendRules(buildFile(t, results).Rules, Deps{"a": src("a", false)}, "", getConfig(vendored))
+	checkOutput(t, findResult(t, amended, "a").rule.AttrStrings("opts"), []string{"-w", "-a"})
+	srcDir := root.Clone()
+	configure(srcDir, "src", nil)
+	build := srcDir.Clone()
+	configure(build, "src/_build", nil)
+	checkOutput(t, getConfig(build).excluded, true)
+	bench := root.Clone()
+	configure(bench, "bench", nil)
+	f := buildFile(t, GenerateRulesAuto("bench", Deps{"a": src("a", false)}, getConfig(bench)))
+	handWritten := rule.NewRule("ocaml_module", "hand_written")
+	handWritten.Insert(f)
+	generated := NewLanguage().GenerateRules(language.GenerateArgs{Config: bench, Rel: "bench", File: f})
+	checkOutput(t, len(generated.Gen), 0)
+	var empty []string
+	for _, r := range generated.Empty {
+		empty = append(empty, r.Name())
+	}
+	checkOutput(t, empty, []string{"a", "#Bench"})
+}
@@ -3,6 +3,7 @@ package okapi
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
@@ -11,7 +12,23 @@ import (
 )
 
 type ResolvedLocal struct{ label label.Label }
-type ResolvedOpam struct{}
+type ResolvedOpam struct{ name string }
+
+// The depspecs from `re_export` of each library, by label.
+type ReExports map[string][]string
+
+// The settings of a local library that determine which implementations of virtual libraries an executable links.
+type LibraryInfo struct {
+	// The depspecs of the library
+	deps []string
+	// The virtual library implemented by the library, as a depspec
+	implements string
+	// The `default_implementation` of a virtual library, as a depspec
+	defaultImpl string
+}
+
+// The local libraries, by label.
+type Libraries map[string]LibraryInfo
 
 func importSpec(name string) resolve.ImportSpec {
 	return resolve.ImportSpec{Lang: okapiName, Imp: name}
@@ -21,10 +38,21 @@ func findImport(c *config.Config, ix *resolve.RuleIndex, name string) []resolve.
 	return ix.FindRulesByImportWithConfig(c, importSpec(name), okapiName)
 }
 
+// Overrides from `okapi_resolve` directives take precedence over the rule index.
 func resolveDep(c *config.Config, ix *resolve.RuleIndex, dep string) interface{} {
+	if resolved, exists := getConfig(c).resolves[dep]; exists {
+		return resolved
+	}
+	if isLabel(dep) {
+		l, err := parseLabel(dep)
+		if err != nil {
+			log.Fatalf("Invalid label in depspecs: %s", err)
+		}
+		return ResolvedLocal{l}
+	}
 	results := findImport(c, ix, dep)
 	if len(results) == 0 {
-		return ResolvedOpam{}
+		return ResolvedOpam{dep}
 	} else if len(results) == 1 {
 		r := results[0]
 		return ResolvedLocal{r.Label}
@@ -44,54 +72,179 @@ func appendLabels(r *rule.Rule, attr string, deps []label.Label) {
 	}
 }
 
+// The libraries re-exported by a local library, including those re-exported by them in turn.
+// The depspecs are resolved in the context of the user, like its own `libraries`.
+func reExported(
+	c *config.Config,
+	ix *resolve.RuleIndex,
+	lib label.Label,
+	reExports ReExports,
+	visited map[string]bool,
+) []interface{} {
+	var result []interface{}
+	for _, dep := range reExports[lib.String()] {
+		resolved := resolveDep(c, ix, dep)
+		if local, isLocal := resolved.(ResolvedLocal); isLocal {
+			if visited[local.label.String()] {
+				continue
+			}
+			visited[local.label.String()] = true
+			result = append(append(result, resolved), reExported(c, ix, local.label, reExports, visited)...)
+		} else {
+			result = append(result, resolved)
+		}
+	}
+	return result
+}
+
 // If the `sig` attr for the module implementing a virtual module isn't set, a `.mli` will be generated and `ocamlfind`
 // will print a warning due to multiple `.cmi` files in the include path, so this sets the `sig` attr to the virtual
 // signature. Since an implementing library may have modules that aren't implementing and have local signatures as well,
 // this is skipped if `sig` is already set.
+// With `(implicit_transitive_deps false)`, the libraries re-exported by local dependencies are added as well, since the
+// module may use them without listing them in `libraries`.
+// Otherwise, the transitive dependencies that OBazl passes to the compiler already include them.
 func libraryDeps(
 	c *config.Config,
 	ix *resolve.RuleIndex,
 	imports interface{},
 	r *rule.Rule,
+	reExports ReExports,
 ) {
 	findDep := func(dep string) interface{} { return resolveDep(c, ix, dep) }
 	virt, _ := ruleConfig(r, "implements")
+	transitive := getConfig(c).project.implicitTransitiveDeps
 	var locals []string
 	var opams []string
 	if deps, isStrings := imports.([]string); isStrings {
+		visited := make(map[string]bool)
 		for _, dep := range deps {
 			resolved := findDep(dep)
 			if local, isLocal := resolved.(ResolvedLocal); isLocal {
+				visited[local.label.String()] = true
+			}
+		}
+		for _, dep := range deps {
+			resolved := []interface{}{findDep(dep)}
+			if local, isLocal := resolved[0].(ResolvedLocal); isLocal {
 				if virt == dep {
 					r.SetAttr("implements", local.label.String())
-				} else {
-					locals = append(locals, local.label.String())
+					continue
+				}
+				if !transitive {
+					resolved = append(resolved, reExported(c, ix, local.label, reExports, visited)...)
+				}
+			}
+			for _, res := range resolved {
+				if local, isLocal := res.(ResolvedLocal); isLocal {
+					locals = appendUnique(locals, local.label.String())
+				} else if opam, isOpam := res.(ResolvedOpam); isOpam {
+					opams = appendUnique(opams, opam.name)
 				}
-			} else if _, isOpam := resolved.(ResolvedOpam); isOpam {
-				opams = append(opams, dep)
 			}
 		}
 		extendAttr(r, "deps", locals)
-		extendAttr(r, "deps_opam", opams)
+		getConfig(c).backend.opamDeps(r, opams)
 	} else {
 		log.Fatalf("Invalid type for imports of source file %s: %#v", r.Name(), imports)
 	}
 }
 
+// The local libraries that are linked into an executable with the depspecs `deps`, including their dependencies and
+// re-exports.
+// Like in `reExported`, the depspecs of the libraries are resolved in the context of the executable.
+func libraryClosure(
+	c *config.Config,
+	ix *resolve.RuleIndex,
+	deps []string,
+	libs Libraries,
+	reExports ReExports,
+) []string {
+	var result []string
+	visited := make(map[string]bool)
+	for len(deps) > 0 {
+		dep := deps[0]
+		deps = deps[1:]
+		if local, isLocal := resolveDep(c, ix, dep).(ResolvedLocal); isLocal && !visited[local.label.String()] {
+			lib := local.label.String()
+			visited[lib] = true
+			result = append(result, lib)
+			deps = append(append(deps, libs[lib].deps...), reExports[lib]...)
+		}
+	}
+	return result
+}
+
+// The implementations of the local virtual libraries in a closure, by the label of the virtual library.
+func implementations(c *config.Config, ix *resolve.RuleIndex, closure []string, libs Libraries) map[string][]string {
+	result := make(map[string][]string)
+	for _, lib := range closure {
+		if virt := libs[lib].implements; virt != "" {
+			if local, isLocal := resolveDep(c, ix, virt).(ResolvedLocal); isLocal {
+				result[local.label.String()] = appendUnique(result[local.label.String()], lib)
+			}
+		}
+	}
+	return result
+}
+
+// Implementations of virtual libraries that an executable depends on directly are added to its `deps`.
+// Virtual libraries in the closure of the executable that aren't implemented by any library in the closure get their
+// `default_implementation`, whose dependencies are added to the closure in turn.
+// Virtual libraries that are implemented by more than one library are an error in Dune, so no implementations are
+// added then.
 func executableDeps(
 	c *config.Config,
 	ix *resolve.RuleIndex,
 	imports interface{},
 	r *rule.Rule,
+	libs Libraries,
+	reExports ReExports,
 ) {
 	if deps, isStrings := imports.([]string); isStrings {
 		var impls []string
 		for _, dep := range deps {
 			for _, lib := range findImport(c, ix, fmt.Sprintf("implementation:%s", dep)) {
-				impls = append(impls, lib.Label.String())
+				impls = appendUnique(impls, lib.Label.String())
+			}
+		}
+		// The direct implementations are part of the closure, so they count for their virtual libraries
+		roots := append(append([]string{}, deps...), impls...)
+		var opams []string
+		for {
+			closure := libraryClosure(c, ix, roots, libs, reExports)
+			implsOf := implementations(c, ix, closure, libs)
+			var defaults []string
+			for _, lib := range closure {
+				if len(implsOf[lib]) > 1 {
+					log.Printf(
+						"executable %s: skipping the implementations of virtual libraries, since it links several "+
+							"implementations of %s: %s",
+						r.Name(),
+						lib,
+						strings.Join(implsOf[lib], ", "),
+					)
+					return
+				} else if len(implsOf[lib]) == 0 && libs[lib].defaultImpl != "" {
+					switch impl := resolveDep(c, ix, libs[lib].defaultImpl).(type) {
+					case ResolvedLocal:
+						// An implementation that doesn't declare `implements` would be chosen again
+						if !contains(impl.label.String(), impls) {
+							defaults = appendUnique(defaults, impl.label.String())
+						}
+					case ResolvedOpam:
+						opams = appendUnique(opams, impl.name)
+					}
+				}
+			}
+			if len(defaults) == 0 {
+				break
 			}
+			impls = appendUnique(impls, defaults...)
+			roots = append(roots, defaults...)
 		}
 		extendAttr(r, "deps", impls)
+		getConfig(c).backend.opamDeps(r, opams)
 	} else {
 		log.Fatalf("Invalid type for imports of executable %s: %#v", r.Name(), imports)
 	}
@@ -0,0 +1,97 @@
+package okapi
+
+import (
+	"path"
+	"strings"
+)
+
+// The subdirectories of a directory that Dune builds, from the fields `dirs`, `data_only_dirs` and `vendored_dirs` of
+// its dune file.
+type Subdirs struct {
+	// The items of `dirs`, or nil for the default `:standard`
+	dirs     []string
+	dataOnly []string
+	vendored []string
+}
+
+// Dune warnings are disabled in vendored directories.
+var vendoredFlags = []string{"-w", "-a"}
+
+// `:standard` matches the directories that don't start with `.` or `_`.
+func matchDir(item string, name string) bool {
+	if item == ":standard" {
+		return !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "_")
+	}
+	matched, err := path.Match(item, name)
+	return err == nil && matched
+}
+
+// Evaluate a simple form of Dune's predicate language, where the items after `\` are excluded.
+func matchDirs(items []string, name string) bool {
+	included := false
+	exclude := false
+	for _, item := range items {
+		if item == `\` {
+			exclude = true
+		} else if matchDir(item, name) {
+			included = !exclude
+		}
+	}
+	return included
+}
+
+func matchAny(items []string, name string) bool {
+	for _, item := range items {
+		if matchDir(item, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether Dune ignores the subdirectory `name`, either because it isn't in `dirs` or only contains data.
+// Without `dirs`, this ignores the directories starting with `.` or `_`, like Dune.
+func (subdirs Subdirs) excludes(name string) bool {
+	dirs := subdirs.dirs
+	if dirs == nil {
+		dirs = []string{":standard"}
+	}
+	return !matchDirs(dirs, name) || matchAny(subdirs.dataOnly, name)
+}
+
+func (subdirs Subdirs) vendors(name string) bool { return matchAny(subdirs.vendored, name) }
+
+// A field with a single nested list, like `(dirs (:standard \ bench))`, is parsed as a map by `parseDune`.
+func decodeDirsField(conf SexpList, field string) []string {
+	for _, node := range conf.Sub {
+		if m, isMap := node.(SexpMap); isMap && m.Name == field && len(m.Values) == 1 {
+			for key, value := range m.Values {
+				rest, _ := sexpStrings(value)
+				return append([]string{key}, rest...)
+			}
+		} else if l, err := node.List(); err == nil && len(l) > 0 && (l[0] == SexpString{field}) {
+			items, err := sexpStrings(SexpList{l[1:]})
+			if err != nil {
+				return nil
+			}
+			return append([]string{}, items...)
+		}
+	}
+	return nil
+}
+
+func decodeSubdirs(conf SexpList) Subdirs {
+	return Subdirs{
+		dirs:     decodeDirsField(conf, "dirs"),
+		dataOnly: decodeDirsField(conf, "data_only_dirs"),
+		vendored: decodeDirsField(conf, "vendored_dirs"),
+	}
+}
+
+// Add the flags of vendored directories, unless they are present already, like in existing modules.
+func vendorFlags(flags []string, conf *Config) []string {
+	if !conf.vendored || (len(flags) >= len(vendoredFlags) && equalStrings(flags[len(flags)-len(vendoredFlags):], vendoredFlags)) {
+		return flags
+	}
+	return append(append([]string{}, flags...), vendoredFlags...)
+}
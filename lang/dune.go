@@ -4,9 +4,12 @@ package okapi
 
 import (
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -14,9 +17,12 @@ type DuneLibDep interface{}
 type DuneLibOpam struct{ name string }
 type DuneLibSelect struct{ Choice ModuleChoice }
 
+// A library from `(re_export name)`, which is visible to the users of the library as well.
+type DuneLibReExport struct{ name string }
+
 type DuneComponentCore struct {
 	names []ComponentName
-	flags []string
+	flags FlagFields
 }
 
 // Either Executable Library
@@ -24,8 +30,8 @@ type DuneComponent struct {
 	core         DuneComponentCore
 	modulesIndex int
 	libraries    []DuneLibDep
-	ppx          bool
-	preprocess   []string
+	preprocess   PpxKind
+	enabledIf    Compatibility
 	kind         KindSpec
 }
 
@@ -36,10 +42,13 @@ type DuneConfig struct {
 	// Modules specs are not directly integrated into `components` because several components may use the same modules (e.g. when an `executables` stanza has more than one executable). This simplifies creating module rules later without risking creating duplicates.
 	// Each component instead stores an `int` key to this modules map
 	modules map[int]ModuleSpec
+	// `rule` stanzas
+	rules []DuneRule
+	// The settings of the enclosing `dune-project`
+	project DuneProject
 }
 
-func parseDune(code string) SexpList {
-	nodes := parseSexp(code)
+func duneStanzas(nodes []SexpNode) SexpList {
 	var result []SexpNode
 	for _, node := range nodes {
 		if l, isList := node.(SexpList); isList {
@@ -51,10 +60,17 @@ func parseDune(code string) SexpList {
 	return SexpList{result}
 }
 
+func parseDune(code string) SexpList { return duneStanzas(parseSexp(code)) }
+
+// Includes are resolved relative to the directory of the dune file.
 func parseDuneFile(duneFile string) SexpList {
 	bytes, _ := ioutil.ReadFile(duneFile)
 	code := string(bytes[:])
-	return parseDune(code)
+	var nodes []SexpNode
+	for _, node := range parseSexp(code) {
+		nodes = append(nodes, expandIncludes(node, filepath.Dir(duneFile)))
+	}
+	return duneStanzas(nodes)
 }
 
 type SexpComponent struct {
@@ -66,23 +82,93 @@ func (lib SexpComponent) fatalf(msg string, v ...interface{}) {
 	log.Fatalf(fmt.Sprintf("dune library %s: ", lib.name)+msg, v...)
 }
 
-func (lib SexpComponent) list(attr string) []string {
-	var result []string
-	raw := lib.data.Values[attr]
-	if raw != nil {
-		items, err := sexpStrings(raw)
-		if err != nil {
-			lib.fatalf("attr %s is not a list of strings: %s: %#v", attr, err, raw)
+// A field in the ordered set language, where an absent field is equivalent to `:standard`.
+func (lib SexpComponent) orderedSet(attr string) orderedSet {
+	raw, exists := lib.data.Values[attr]
+	if !exists {
+		return setStandard{}
+	}
+	set, err := decodeOrderedSet(raw)
+	if err != nil {
+		lib.fatalf("attr %s is not an ordered set: %s: %#v", attr, err, raw)
+	}
+	for _, file := range unexpandedIncludes(raw) {
+		log.Printf("WARNING: dune %s: ignoring (:include %s) in %s, since the file is generated by a rule", lib.stanza(), file, attr)
+	}
+	return set
+}
+
+// The kind of the stanza followed by its `name` or `names`, for messages.
+func (lib SexpComponent) stanza() string {
+	for _, field := range []string{"name", "names"} {
+		raw, exists := lib.data.Values[field]
+		if !exists {
+			continue
 		}
-		for _, item := range items {
-			if item[:1] != ":" {
-				result = append(result, item)
-			}
+		if names, err := sexpStrings(raw); err == nil && len(names) > 0 {
+			return lib.data.Name + " " + strings.Join(names, " ")
 		}
 	}
+	return lib.data.Name
+}
+
+// A field listing modules, whose names are converted to the file names of the modules, like `Foo` to `foo`.
+func (lib SexpComponent) modules(attr string) []string { return untitleCaseAll(lib.list(attr)) }
+
+// A field in the ordered set language, for which `:standard` is empty.
+func (lib SexpComponent) list(attr string) []string {
+	if lib.data.Values[attr] == nil {
+		return nil
+	}
+	return evalOrderedSet(lib.orderedSet(attr), nil)
+}
+
+// A field that is a plain list of strings, like the targets of a rule.
+func (lib SexpComponent) strings(attr string) []string {
+	raw := lib.data.Values[attr]
+	if raw == nil {
+		return nil
+	}
+	items, err := sexpStrings(raw)
+	if err != nil {
+		lib.fatalf("attr %s is not a list of strings: %s: %#v", attr, err, raw)
+	}
+	return items
+}
+
+// A field containing other fields, like `(foreign_stubs (language c) (names foo))`.
+func (lib SexpComponent) field(key string) (SexpComponent, bool) {
+	raw, exists := lib.data.Values[key]
+	if !exists {
+		return SexpComponent{}, false
+	}
+	return lib.decodeField(key, raw), true
+}
+
+// All occurrences of a field in `repeatedFields` that contains other fields.
+func (lib SexpComponent) fields(key string) []SexpComponent {
+	var result []SexpComponent
+	for _, raw := range lib.data.Repeated[key] {
+		result = append(result, lib.decodeField(key, raw))
+	}
 	return result
 }
 
+func (lib SexpComponent) decodeField(key string, raw SexpNode) SexpComponent {
+	fields, err := raw.List()
+	if err != nil {
+		lib.fatalf("invalid field %s: %#v", key, raw)
+	}
+	data, isMap := sexpMap(append([]SexpNode{SexpString{key}}, fields...)).(SexpMap)
+	if !isMap {
+		if len(fields) > 0 {
+			lib.fatalf("invalid field %s: %#v", key, raw)
+		}
+		data = SexpMap{Name: key, Values: map[string]SexpNode{}}
+	}
+	return SexpComponent{lib.name, data}
+}
+
 func (lib SexpComponent) stringOr(key string, def string) string {
 	raw, exists := lib.data.Values[key]
 	if exists {
@@ -110,6 +196,7 @@ func decodeDuneLibraryDeps(lib SexpComponent) []DuneLibDep {
 	var deps []DuneLibDep
 	raw := lib.data.Values["libraries"]
 	selectString := SexpString{"select"}
+	reExportString := SexpString{"re_export"}
 	if raw != nil {
 		entries, err := raw.List()
 		if err != nil {
@@ -124,7 +211,13 @@ func decodeDuneLibraryDeps(lib SexpComponent) []DuneLibDep {
 				if err != nil {
 					lib.fatalf("unparsable libraries entry: %#v; %s", sel, err)
 				}
-				if len(sel) > 3 && sel[0] == selectString {
+				if len(sel) == 2 && sel[0] == reExportString {
+					name, err := sel[1].String()
+					if err != nil {
+						lib.fatalf("invalid re_export: %#v", sel)
+					}
+					deps = append(deps, DuneLibReExport{name})
+				} else if len(sel) > 3 && sel[0] == selectString {
 					var alts []ModuleAlt
 					for _, alt := range sel[3:] {
 						ss, err := sexpStrings(alt)
@@ -148,37 +241,153 @@ func decodeDuneLibraryDeps(lib SexpComponent) []DuneLibDep {
 	return deps
 }
 
-func decodeDunePreprocessors(lib SexpComponent) []string {
+// Split the arguments of `pps` into the rewriters and the arguments for the driver.
+// Like in Dune, arguments starting with `-` are flags, and everything after `--` is passed to the driver verbatim.
+func decodePps(lib SexpComponent, args []SexpNode, data []string) PpxKind {
+	items, err := sexpStrings(SexpList{args})
+	if err != nil {
+		lib.fatalf("invalid pps: %s: %#v", err, args)
+	}
+	result := PpxDirect{data: data}
+	for i, item := range items {
+		if item == "--" {
+			result.args = append(result.args, items[i+1:]...)
+			break
+		} else if strings.HasPrefix(item, "-") {
+			result.args = append(result.args, item)
+		} else {
+			result.deps = append(result.deps, item)
+		}
+	}
+	return result
+}
+
+// Only `run` actions are supported, whose last argument is `%{input-file}`, which the compiler appends to the command
+// given with `-pp`.
+// `%{bin:program}` is replaced by the program's name, which is looked up in the `PATH` of the build, and
+// `%{ocaml_version}` is kept until the rules are generated, see `PpxAction.command`.
+func decodePpAction(lib SexpComponent, action SexpNode) PpxKind {
+	items, err := sexpStrings(action)
+	if err != nil || len(items) < 3 || items[0] != "run" || items[len(items)-1] != "%{input-file}" {
+		log.Printf("dune library %s: skipping unsupported preprocessing action: %#v", lib.name, action)
+		return NoPpx{}
+	}
+	var words []string
+	var tools []string
+	for _, arg := range items[1 : len(items)-1] {
+		match := duneVariable.FindStringSubmatch(arg)
+		if match != nil && match[0] == arg && strings.HasPrefix(match[1], "bin:") {
+			tool := strings.TrimPrefix(match[1], "bin:")
+			words = append(words, tool)
+			tools = appendUnique(tools, tool)
+		} else if duneVariable.MatchString(strings.ReplaceAll(arg, ocamlVersionVariable, "")) {
+			log.Printf("dune library %s: skipping preprocessing action with unsupported variable: %s", lib.name, arg)
+			return NoPpx{}
+		} else {
+			words = append(words, shellQuote(arg))
+		}
+	}
+	return PpxAction{strings.Join(words, " "), strings.Join(tools, " ")}
+}
+
+// Each entry of `per_module` is a spec followed by the names of the modules it applies to.
+func decodePerModule(lib SexpComponent, entries []SexpNode, data []string) PpxKind {
+	result := PpxPerModule{modules: make(map[string]int)}
+	for _, entry := range entries {
+		elems, err := entry.List()
+		if err != nil || len(elems) < 2 {
+			lib.fatalf("invalid per_module entry: %#v", entry)
+		}
+		spec := decodePreprocessSpec(lib, elems[0], data)
+		if _, isPerModule := spec.(PpxPerModule); isPerModule {
+			lib.fatalf("nested per_module: %#v", entry)
+		}
+		modules, err := sexpStrings(SexpList{elems[1:]})
+		if err != nil {
+			lib.fatalf("invalid modules in per_module: %s: %#v", err, entry)
+		}
+		for _, module := range modules {
+			result.modules[untitleCase(module)] = len(result.specs)
+		}
+		result.specs = append(result.specs, spec)
+	}
+	return result
+}
+
+func decodePreprocessSpec(lib SexpComponent, spec SexpNode, data []string) PpxKind {
+	if name, isString := spec.(SexpString); isString {
+		if name.Content == "no_preprocessing" || name.Content == "future_syntax" {
+			return NoPpx{}
+		}
+		lib.fatalf("invalid preprocess spec: %s", name.Content)
+	}
+	elems, err := spec.List()
+	if err != nil || len(elems) == 0 {
+		lib.fatalf("invalid preprocess spec: %#v", spec)
+	}
+	name, _ := elems[0].String()
+	switch name {
+	case "pps", "staged_pps":
+		return decodePps(lib, elems[1:], data)
+	case "action":
+		if len(elems) != 2 {
+			lib.fatalf("invalid preprocessing action: %#v", spec)
+		}
+		return decodePpAction(lib, elems[1])
+	case "per_module":
+		return decodePerModule(lib, elems[1:], data)
+	default:
+		log.Printf("dune library %s: skipping unsupported preprocess spec: %#v", lib.name, spec)
+		return NoPpx{}
+	}
+}
+
+// Files in `preprocessor_deps` are given either by name or as `(file name)`.
+func decodePreprocessorDeps(lib SexpComponent) []string {
+	raw, exists := lib.data.Values["preprocessor_deps"]
+	if !exists {
+		return nil
+	}
+	items, err := raw.List()
+	if err != nil {
+		lib.fatalf("invalid preprocessor_deps: %#v", raw)
+	}
 	var result []string
-	raw := lib.data.Values["preprocess"]
-	if raw != nil {
-		if items, err := raw.List(); err == nil {
-			for _, item := range items {
-				elems, err := item.List()
-				pps := SexpString{"pps"}
-				if err == nil && len(elems) == 2 && elems[0] == pps {
-					pp, stringErr := elems[1].String()
-					if stringErr != nil {
-						lib.fatalf("dune library %s: pps is not a string: %#v", elems[1])
-					}
-					result = append(result, pp)
-				}
-			}
+	for _, item := range items {
+		if file, err := item.String(); err == nil {
+			result = append(result, file)
+		} else if dep, err := sexpStrings(item); err == nil && len(dep) == 2 && dep[0] == "file" {
+			result = append(result, dep[1])
 		} else {
-			lib.fatalf("invalid `preprocess` directive: %#v", raw)
+			log.Printf("dune library %s: skipping unsupported preprocessor dependency: %#v", lib.name, item)
 		}
 	}
 	return result
 }
 
-func decodeDuneModules(names []string) ModuleSpec {
-	if len(names) == 0 {
+func decodeDunePreprocessors(lib SexpComponent) PpxKind {
+	raw, exists := lib.data.Values["preprocess"]
+	if !exists {
+		return NoPpx{}
+	}
+	spec := raw
+	if l, isList := raw.(SexpList); isList && len(l.Sub) == 1 {
+		spec = l.Sub[0]
+	}
+	return decodePreprocessSpec(lib, spec, decodePreprocessorDeps(lib))
+}
+
+// An absent `modules` field is equivalent to `:standard`.
+func decodeDuneModules(lib SexpComponent) ModuleSpec {
+	set := evalModuleSet(lib.orderedSet("modules"))
+	set.modules = untitleCaseAll(set.modules)
+	set.excluded = untitleCaseAll(set.excluded)
+	if !set.standard {
+		return ConcreteModules{set.modules}
+	} else if len(set.excluded) == 0 && len(set.modules) == 0 {
 		return AutoModules{}
-	} else if names[0] == "\\" {
-		return ExcludeModules{names[1:]}
-	} else {
-		return ConcreteModules{names}
 	}
+	return ExcludeModules{set.excluded, set.modules}
 }
 
 func decodeDuneLibraryKind(lib SexpComponent, name ComponentName) KindSpec {
@@ -186,36 +395,47 @@ func decodeDuneLibraryKind(lib SexpComponent, name ComponentName) KindSpec {
 	return LibSpec{
 		name:           name,
 		wrapped:        wrapped,
-		virtualModules: lib.list("virtual_modules"),
+		virtualModules: lib.modules("virtual_modules"),
 		implements:     lib.stringOptional("implements"),
+		stubs:          decodeForeignStubs(lib),
+		inlineTests:    decodeInlineTests(lib),
+		privateModules: lib.modules("private_modules"),
+		reExports:      reExports(decodeDuneLibraryDeps(lib)),
+		noImpl:         lib.modules("modules_without_implementation"),
+		defaultImpl:    lib.stringOptional("default_implementation"),
 	}
 }
 
-func decodeDuneExeKind(lib SexpComponent) KindSpec {
+func decodeDuneExeKind(lib SexpComponent, project DuneProject) KindSpec {
+	spec := ExeSpec{
+		modes:     decodeDuneModes(lib),
+		linkFlags: lib.list("link_flags"),
+		emptyIntf: project.executablesImplicitEmptyIntf,
+	}
 	if lib.data.Name == "executable" || lib.data.Name == "executables" {
-		return ExeSpec{test: false}
+		return spec
 	} else if lib.data.Name == "test" || lib.data.Name == "tests" {
-		return ExeSpec{test: true}
+		spec.test = true
+		return spec
 	}
 	return nil
 }
 
 func decodeDuneComponent(data SexpComponent, names []ComponentName, conf SexpMap, moduleIndex int, kind KindSpec) DuneComponent {
-	preproc := decodeDunePreprocessors(data)
 	return DuneComponent{
 		core: DuneComponentCore{
 			names: names,
-			flags: data.list("flags"),
+			flags: decodeFlagFields(data),
 		},
 		modulesIndex: moduleIndex,
 		libraries:    decodeDuneLibraryDeps(data),
-		ppx:          len(preproc) > 0,
-		preprocess:   preproc,
+		preprocess:   decodeDunePreprocessors(data),
+		enabledIf:    decodeEnabledIf(data),
 		kind:         kind,
 	}
 }
 
-func decodeDuneExecutables(libName string, conf SexpMap, moduleIndex int) DuneComponent {
+func decodeDuneExecutables(libName string, conf SexpMap, moduleIndex int, project DuneProject) DuneComponent {
 	data := SexpComponent{libName, conf}
 	names := data.list("names")
 	publicNames := names
@@ -226,10 +446,50 @@ func decodeDuneExecutables(libName string, conf SexpMap, moduleIndex int) DuneCo
 	for i, name := range names {
 		componentNames = append(componentNames, ComponentName{name, publicNames[i]})
 	}
-	return decodeDuneComponent(data, componentNames, conf, moduleIndex, decodeDuneExeKind(data))
+	return decodeDuneComponent(data, componentNames, conf, moduleIndex, decodeDuneExeKind(data, project))
+}
+
+// Parse Dune `menhir` stanzas, mapping each parser module to the flags that are passed to menhir.
+// Stanzas that merge several grammars with `merge_into` aren't supported.
+func decodeMenhir(conf SexpList) map[string][]string {
+	result := make(map[string][]string)
+	for _, node := range conf.Sub {
+		if dune, isMap := node.(SexpMap); isMap && dune.Name == "menhir" {
+			data := SexpComponent{"menhir", dune}
+			if _, merged := dune.Values["merge_into"]; merged {
+				log.Printf("Skipping menhir stanza with `merge_into`: %#v", dune)
+				continue
+			}
+			flags := data.list("flags")
+			for _, mod := range data.list("modules") {
+				result[mod] = flags
+			}
+		}
+	}
+	return result
 }
 
-// Parse Dune `ocamllex` stanzas (which indicate source files that will be generated by `ocamllex` during build).
+// Parse Dune `ocamlyacc` stanzas, which list the parser modules either directly or in a `modules` field.
+func decodeOcamlyacc(conf SexpList) []string {
+	var result []string
+	for _, node := range conf.Sub {
+		if dune, isMap := node.(SexpMap); isMap && dune.Name == "ocamlyacc" {
+			result = append(result, SexpComponent{"ocamlyacc", dune}.list("modules")...)
+		} else if l, err := node.List(); err == nil && len(l) >= 2 && (l[0] == SexpString{"ocamlyacc"}) {
+			for _, mod := range l[1:] {
+				if name, err := mod.String(); err == nil {
+					result = append(result, name)
+				} else {
+					log.Fatalf("Invalid name for ocamlyacc: %#v", mod)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Parse Dune `ocamllex`, `ocamlyacc`, `menhir` and `rule` stanzas (which indicate source files that will be generated
+// during build).
 func decodeGeneratedSources(conf SexpList) []string {
 	var result []string
 	for _, node := range conf.Sub {
@@ -243,10 +503,185 @@ func decodeGeneratedSources(conf SexpList) []string {
 			}
 		}
 	}
+	result = append(result, decodeOcamlyacc(conf)...)
+	result = append(result, ruleModuleNames(decodeDuneRules(conf))...)
+	var parsers []string
+	for mod := range decodeMenhir(conf) {
+		parsers = append(parsers, mod)
+	}
+	sort.Strings(parsers)
+	return append(result, parsers...)
+}
+
+// Parse Dune `copy_files` and `copy_files#` stanzas, returning the glob patterns of the copied files, which are relative
+// to the directory of the dune file.
+func decodeCopyFiles(conf SexpList) []string {
+	var result []string
+	for _, node := range conf.Sub {
+		if dune, isMap := node.(SexpMap); isMap && (dune.Name == "copy_files" || dune.Name == "copy_files#") {
+			result = append(result, SexpComponent{dune.Name, dune}.string("files"))
+		} else if l, err := node.List(); err == nil && len(l) == 2 {
+			if (l[0] == SexpString{"copy_files"}) || (l[0] == SexpString{"copy_files#"}) {
+				if glob, err := l[1].String(); err == nil {
+					result = append(result, glob)
+				} else {
+					log.Fatalf("Invalid glob for copy_files: %#v", l[1])
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Dune globs may contain alternatives like `*.{ml,mli}`, which aren't supported by `filepath.Glob`.
+func expandBraces(pattern string) []string {
+	start := strings.Index(pattern, "{")
+	end := strings.Index(pattern, "}")
+	if start < 0 || end < start {
+		return []string{pattern}
+	}
+	var result []string
+	for _, alt := range strings.Split(pattern[start+1:end], ",") {
+		result = append(result, expandBraces(pattern[:start]+alt+pattern[end+1:])...)
+	}
+	return result
+}
+
+// The absolute paths of the files matched by `copy_files` patterns in `dir`.
+func copiedFiles(dir string, patterns []string) []string {
+	var result []string
+	for _, pattern := range patterns {
+		for _, expanded := range expandBraces(pattern) {
+			matches, err := filepath.Glob(filepath.Join(dir, expanded))
+			if err != nil {
+				log.Fatalf("Invalid copy_files pattern %s in %s: %s", pattern, dir, err)
+			}
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && !info.IsDir() {
+					result = appendUnique(result, match)
+				}
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Files of a package that another package copies with `copy_files`.
+type CopiedFiles struct {
+	// The copying package
+	copier string
+	// The names of the files in their package
+	files []string
+}
+
+// Find the `copy_files` stanzas of all Dune files in the repository, and map the packages containing the copied files
+// to the packages copying them.
+// Like when generating rules, the directories that Dune ignores, like `_build` or those excluded by `dirs`, and the
+// output directories of Bazel are skipped.
+func scanCopiedFiles(repoRoot string) map[string][]CopiedFiles {
+	result := make(map[string][]CopiedFiles)
+	subdirs := make(map[string]Subdirs)
+	err := filepath.WalkDir(repoRoot, func(dir string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipping %s while looking for copy_files: %s", dir, err)
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if dir != repoRoot {
+			name := entry.Name()
+			if strings.HasPrefix(name, "bazel-") || subdirs[filepath.Dir(dir)].excludes(name) {
+				return filepath.SkipDir
+			}
+		}
+		dune, exists := readDune(dir)
+		if !exists {
+			return nil
+		}
+		subdirs[dir] = decodeSubdirs(dune)
+		copier, _ := filePackage(repoRoot, filepath.Join(dir, "dune"))
+		var sources []string
+		bySource := make(map[string][]string)
+		for _, copied := range copiedFiles(dir, decodeCopyFiles(dune)) {
+			if src, inRepo := filePackage(repoRoot, copied); inRepo {
+				sources = appendUnique(sources, src)
+				bySource[src] = append(bySource[src], filepath.Base(copied))
+			}
+		}
+		for _, src := range sources {
+			result[src] = append(result[src], CopiedFiles{copier, bySource[src]})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to look for copy_files in %s: %s", repoRoot, err)
+	}
 	return result
 }
 
-func decodeDuneConfig(libName string, conf SexpList) DuneConfig {
+// The generators for source files that aren't recognized by their extension, as declared in the dune file at `path`.
+// Returns nil if there is no dune file.
+func duneGenerators(path string) map[string]Generator {
+	if path == "" {
+		return nil
+	}
+	result := make(map[string]Generator)
+	conf := parseDuneFile(path)
+	for _, mod := range decodeOcamlyacc(conf) {
+		result[mod] = Ocamlyacc{}
+	}
+	for mod, intf := range ruleModules(decodeDuneRules(conf)) {
+		result[mod] = RuleTarget{intf}
+	}
+	for _, file := range copiedFiles(filepath.Dir(path), decodeCopyFiles(conf)) {
+		name := extractDependencyname(file)
+		cp, _ := result[name].(Copy)
+		if filepath.Ext(file) == ".ml" {
+			cp.ml = file
+		} else if filepath.Ext(file) == ".mli" {
+			cp.mli = file
+		} else {
+			continue
+		}
+		result[name] = cp
+	}
+	for mod, flags := range decodeMenhir(conf) {
+		result[mod] = Menhir{flags}
+	}
+	return result
+}
+
+const (
+	includeUnqualified = "unqualified"
+	includeQualified   = "qualified"
+)
+
+// Parse the Dune `include_subdirs` stanza, which causes the sources in all subdirectories to belong to the stanzas in
+// the directory's dune file.
+// Returns the empty string if the stanza is absent or `no`.
+func decodeIncludeSubdirs(conf SexpList) string {
+	for _, node := range conf.Sub {
+		if l, err := node.List(); err == nil && len(l) == 2 && (l[0] == SexpString{"include_subdirs"}) {
+			mode, err := l[1].String()
+			if err != nil || !(mode == includeUnqualified || mode == includeQualified || mode == "no") {
+				log.Fatalf("Invalid mode for include_subdirs: %#v", l[1])
+			}
+			if mode == "no" {
+				return ""
+			}
+			return mode
+		}
+	}
+	return ""
+}
+
+// The settings of the `dune-project` determine the defaults of the stanzas.
+func decodeDuneConfig(libName string, conf SexpList, project DuneProject) DuneConfig {
 	var components []DuneComponent
 	generatedSources := decodeGeneratedSources(conf)
 	moduleIndex := 0
@@ -255,7 +690,7 @@ func decodeDuneConfig(libName string, conf SexpList) DuneConfig {
 		dune, isMap := node.(SexpMap)
 		if isMap {
 			data := SexpComponent{libName, dune}
-			modules[moduleIndex] = decodeDuneModules(data.list("modules"))
+			modules[moduleIndex] = decodeDuneModules(data)
 			if dune.Name == "library" {
 				name := data.string("name")
 				componentName := ComponentName{name, data.stringOr("public_name", name)}
@@ -263,14 +698,20 @@ func decodeDuneConfig(libName string, conf SexpList) DuneConfig {
 			} else if dune.Name == "executable" || dune.Name == "test" {
 				name := data.string("name")
 				componentName := ComponentName{name, data.stringOr("public_name", name)}
-				components = append(components, decodeDuneComponent(data, []ComponentName{componentName}, dune, moduleIndex, decodeDuneExeKind(data)))
+				components = append(components, decodeDuneComponent(data, []ComponentName{componentName}, dune, moduleIndex, decodeDuneExeKind(data, project)))
 			} else if dune.Name == "executables" || dune.Name == "tests" {
-				components = append(components, decodeDuneExecutables(libName, dune, moduleIndex))
+				components = append(components, decodeDuneExecutables(libName, dune, moduleIndex, project))
 			}
 			moduleIndex += 1
 		}
 	}
-	return DuneConfig{components: components, generated: generatedSources, modules: modules}
+	return DuneConfig{
+		components: components,
+		generated:  generatedSources,
+		modules:    modules,
+		rules:      decodeDuneRules(conf),
+		project:    project,
+	}
 }
 
 func contains(target string, items []string) bool {
@@ -330,20 +771,23 @@ func duneChoices(libs []DuneLibDep) []Source {
 func opamDeps(deps []DuneLibDep) []string {
 	var result []string
 	for _, dep := range deps {
-		ld, isOpam := dep.(DuneLibOpam)
-		if isOpam {
+		if ld, isOpam := dep.(DuneLibOpam); isOpam {
 			result = append(result, ld.name)
+		} else if re, isReExport := dep.(DuneLibReExport); isReExport {
+			result = append(result, re.name)
 		}
 	}
 	return result
 }
 
-func dunePpx(deps []string) PpxKind {
-	if len(deps) > 0 {
-		return PpxDirect{deps}
-	} else {
-		return NoPpx{}
+func reExports(deps []DuneLibDep) []string {
+	var result []string
+	for _, dep := range deps {
+		if re, isReExport := dep.(DuneLibReExport); isReExport {
+			result = append(result, re.name)
+		}
 	}
+	return result
 }
 
 func libKind(ppx bool, wrapped bool) LibraryKind {
@@ -409,9 +853,22 @@ func untitleCase(name string) string {
 	return strings.ToLower(name[:1]) + name[1:]
 }
 
+func untitleCaseAll(names []string) []string {
+	var result []string
+	for _, name := range names {
+		result = append(result, untitleCase(name))
+	}
+	return result
+}
+
 func moduleSources(names []string, sources Deps, choices []Source) []Source {
 	var result SourceSlice
+	seen := make(map[string]bool)
 	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
 		if src, exists := sources[name]; exists {
 			result = append(result, src)
 		} else if src, exists := sources[untitleCase(name)]; exists {
@@ -426,7 +883,6 @@ func moduleSources(names []string, sources Deps, choices []Source) []Source {
 }
 
 func duneComponentToSpec(dune DuneComponent, modules ModuleSpec) ([]ComponentSpec, SourcesSpec) {
-	ppx := dunePpx(dune.preprocess)
 	choices := duneChoices(dune.libraries)
 	fullModules := modulesWithSelectOutputs(modules, dune.libraries)
 	_, isExe := dune.kind.(ExeSpec)
@@ -444,13 +900,14 @@ func duneComponentToSpec(dune DuneComponent, modules ModuleSpec) ([]ComponentSpe
 	}
 
 	return result, SourcesSpec{
-		modules:  fullModules,
-		choices:  choices,
-		ppx:      ppx,
-		depsOpam: opamDeps(dune.libraries),
-		kind:     dune.kind,
-		flags:    dune.core.flags,
-		mains:    mains,
+		modules:   fullModules,
+		choices:   choices,
+		ppx:       dune.preprocess,
+		depsOpam:  opamDeps(dune.libraries),
+		kind:      dune.kind,
+		fields:    &dune.core.flags,
+		enabledIf: dune.enabledIf,
+		mains:     mains,
 	}
 }
 
@@ -461,6 +918,11 @@ func duneToSpec(config DuneConfig) PackageSpec {
 	for _, comp := range config.components {
 		compModules := config.modules[comp.modulesIndex]
 		comps, fullModules := duneComponentToSpec(comp, compModules)
+		if _, isLib := comp.kind.(LibSpec); isLib {
+			for _, name := range comp.core.names {
+				config.project.checkDepends(name, fullModules.depsOpam)
+			}
+		}
 		components = append(components, comps...)
 		modules[comp.modulesIndex] = fullModules
 	}
@@ -469,7 +931,17 @@ func duneToSpec(config DuneConfig) PackageSpec {
 		components: components,
 		generated:  config.generated,
 		modules:    modules,
+		rules:      config.rules,
+	}
+}
+
+// Parse the dune file in `dir`, if there is one.
+func readDune(dir string) (SexpList, bool) {
+	path := filepath.Join(dir, "dune")
+	if _, err := os.Stat(path); err != nil {
+		return SexpList{}, false
 	}
+	return parseDuneFile(path), true
 }
 
 func findDune(dir string, files []string) string {
@@ -1,8 +1,19 @@
 package okapi
 
 import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 const duneFile = `(library
@@ -27,14 +38,18 @@ const duneFile = `(library
 
 func TestDuneParse(t *testing.T) {
 	sexp := parseDune(duneFile)
-	output := decodeDuneConfig("test", sexp)
+	output := decodeDuneConfig("test", sexp, defaultProject)
 	target1 := DuneComponent{
 		core: DuneComponentCore{
 			names: []ComponentName{{
 				name:   "sub_lib",
 				public: "sub-lib",
 			}},
-			flags: []string{"-open", "Angstrom"},
+			flags: FlagFields{
+				flags:  setUnion{setUnion{setStandard{}, setElement("-open"), setElement("Angstrom")}},
+				byte:   setStandard{},
+				native: setStandard{},
+			},
 		},
 		modulesIndex: 0,
 		libraries: []DuneLibDep{
@@ -46,8 +61,7 @@ func TestDuneParse(t *testing.T) {
 				{"", "choice2.ml"},
 			}}},
 		},
-		ppx:        false,
-		preprocess: nil,
+		preprocess: NoPpx{},
 		kind: LibSpec{
 			name:           ComponentName{"sub_lib", "sub-lib"},
 			wrapped:        true,
@@ -61,12 +75,11 @@ func TestDuneParse(t *testing.T) {
 				name:   "sub_extra_lib",
 				public: "sub-extra-lib",
 			}},
-			flags: nil,
+			flags: FlagFields{setStandard{}, setStandard{}, setStandard{}},
 		},
 		modulesIndex: 1,
 		libraries:    nil,
-		ppx:          true,
-		preprocess:   []string{"ppx_inline_test"},
+		preprocess:   PpxDirect{deps: []string{"ppx_inline_test"}},
 		kind: LibSpec{
 			name:           ComponentName{"sub_extra_lib", "sub-extra-lib"},
 			wrapped:        true,
@@ -77,7 +90,7 @@ func TestDuneParse(t *testing.T) {
 	conc := ConcreteModules{[]string{"foo", "bar"}}
 	targets := []DuneComponent{target1, target2}
 	mods := map[int]ModuleSpec{0: AutoModules{}, 1: conc}
-	conf := DuneConfig{targets, nil, mods}
+	conf := DuneConfig{targets, nil, mods, nil, defaultProject}
 	if !reflect.DeepEqual(output, conf) {
 		t.Fatalf("Dune library differs.\nOutput:\n%#v\nTarget:\n%#v", output, conf)
 	}
@@ -103,7 +116,7 @@ func TestDuneAssignGenerated(t *testing.T) {
 	}
 	comps := []DuneComponent{comp1, comp2, comp3}
 	generated := []string{"lex1", "lex2", "lex3"}
-	conf := DuneConfig{comps, generated, mods}
+	conf := DuneConfig{comps, generated, mods, nil, defaultProject}
 	spec := duneToSpec(conf)
 	result := assignGenerated(spec)
 	target := map[int][]string{
@@ -125,12 +138,12 @@ func TestDuneExecutables(t *testing.T) {
     )
     `
 	sexp := parseDune(duneFile)
-	duneConfig := decodeDuneConfig("test", sexp)
+	duneConfig := decodeDuneConfig("test", sexp, defaultProject)
 	spec := duneToSpec(duneConfig)
 	deps := make(map[string]Source)
-	deps["Module1"] = Source{name: "foo", intf: false, virtual: false, deps: []string{}, generator: NoGenerator{}}
-	deps["Module2"] = Source{name: "bar", intf: false, virtual: false, deps: []string{}, generator: NoGenerator{}}
-	results := multilib(spec, deps, false)
+	deps["module1"] = Source{name: "foo", intf: false, virtual: false, deps: []string{}, generator: NoGenerator{}}
+	deps["module2"] = Source{name: "bar", intf: false, virtual: false, deps: []string{}, generator: NoGenerator{}}
+	results := multilib(spec, deps, defaultConfig())
 	if len(results) != 4 {
 		t.Logf("Incorrect number of rules generated!")
 		t.Logf("Expected 4 rules (2 x 1 per module + 2 x 1 per executable).")
@@ -141,3 +154,567 @@ func TestDuneExecutables(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestDecodeIncludeSubdirs(t *testing.T) {
+	checkOutput(t, decodeIncludeSubdirs(parseDune("(include_subdirs qualified)\n(library (name a))")), includeQualified)
+	checkOutput(t, decodeIncludeSubdirs(parseDune("(include_subdirs no)")), "")
+	checkOutput(t, decodeIncludeSubdirs(parseDune(duneFile)), "")
+}
+
+const menhirDune = `(library (name calc))
+(ocamllex lexer)
+(menhir (modules parser) (flags --explain --table))
+(menhir (modules tokens))`
+
+func TestDecodeMenhir(t *testing.T) {
+	conf := parseDune(menhirDune)
+	checkOutput(t, decodeMenhir(conf), map[string][]string{"parser": {"--explain", "--table"}, "tokens": nil})
+	checkOutput(t, decodeGeneratedSources(conf), []string{"lexer", "parser", "tokens"})
+}
+
+func TestMenhirRules(t *testing.T) {
+	sources := Deps{
+		"calc":   src("calc", false, "parser"),
+		"parser": {name: "parser", intf: true, generator: Menhir{[]string{"--table"}}},
+	}
+	spec := duneToSpec(decodeDuneConfig("calc", parseDune("(library (name calc))\n(menhir (modules parser) (flags --table))"), defaultProject))
+	results := multilib(spec, sources, defaultConfig())
+	gen := findResult(t, results, "parser_parser").rule
+	checkOutput(t, gen.AttrStrings("outs"), []string{"parser.ml", "parser.mli"})
+	checkOutput(t, gen.AttrString("cmd"), "menhir --table --base $(RULEDIR)/parser $(location :parser.mly)")
+	checkOutput(t, findResult(t, results, "parser").rule.AttrString("sig"), ":parser__sig")
+	checkOutput(t, findResult(t, results, "parser__sig").rule.AttrString("src"), ":parser.mli")
+	checkOutput(t, findResult(t, results, "#Calc").rule.AttrStrings("submodules"), []string{":calc", ":parser"})
+}
+
+func TestOcamlyacc(t *testing.T) {
+	conf := parseDune("(library (name calc))\n(ocamlyacc parser)\n(ocamlyacc (modules expr))")
+	checkOutput(t, decodeGeneratedSources(conf), []string{"parser", "expr"})
+	sources := Deps{
+		"calc":   src("calc", false, "parser"),
+		"expr":   {name: "expr", intf: true, generator: Ocamlyacc{}},
+		"parser": {name: "parser", intf: true, generator: Ocamlyacc{}},
+	}
+	results := multilib(duneToSpec(decodeDuneConfig("calc", conf, defaultProject)), sources, defaultConfig())
+	gen := findResult(t, results, "parser_parser").rule
+	checkOutput(t, gen.AttrString("cmd"), "ocamlyacc -b $(RULEDIR)/parser $(location :parser.mly)")
+	checkOutput(t, isGenerator(gen), true)
+	checkOutput(t, findResult(t, results, "#Calc").rule.AttrStrings("submodules"), []string{":calc", ":expr", ":parser"})
+}
+
+const rulesDune = `(library (name calc))
+(rule
+ (targets version.ml)
+ (deps version.txt (:gen gen.sh))
+ (action (with-stdout-to %{targets} (run %{gen} --input version.txt "a b"))))
+(rule (copy defs.ml.in defs.ml))
+(rule (targets data.txt) (action (system "cat %{deps} > %{targets}")))
+(rule (targets other.ml) (action (progn)))`
+
+func TestDuneRules(t *testing.T) {
+	conf := parseDune(rulesDune)
+	checkOutput(t, decodeGeneratedSources(conf), []string{"defs", "version"})
+	sources := Deps{
+		"calc":    src("calc", false, "version"),
+		"defs":    {name: "defs", generator: RuleTarget{}},
+		"version": {name: "version", generator: RuleTarget{}},
+	}
+	results := multilib(duneToSpec(decodeDuneConfig("calc", conf, defaultProject)), sources, defaultConfig())
+	version := findResult(t, results, "version_gen").rule
+	checkOutput(t, version.AttrStrings("srcs"), []string{":version.txt", ":gen.sh"})
+	checkOutput(t, version.AttrStrings("outs"), []string{"version.ml"})
+	checkOutput(t, version.AttrString("cmd"), "$(location :gen.sh) --input $(location :version.txt) 'a b' > $(OUTS)")
+	checkOutput(t, findResult(t, results, "defs_gen").rule.AttrString("cmd"), "cp $(location :defs.ml.in) $(location :defs.ml)")
+	checkOutput(t, findResult(t, results, "data_gen").rule.AttrString("cmd"), "cat $(SRCS) > $(OUTS)")
+	checkOutput(t, findResult(t, results, "version").rule.AttrString("struct"), ":version.ml")
+	checkOutput(t, findResult(t, results, "#Calc").rule.AttrStrings("submodules"), []string{":calc", ":defs", ":version"})
+	checkOutput(t, isGenerator(version), true)
+	dune := filepath.Join(t.TempDir(), "dune")
+	if err := os.WriteFile(dune, []byte(strings.Replace(rulesDune, "(rule (copy defs.ml.in defs.ml))", "", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := buildFile(t, results)
+	delete(sources, "defs")
+	amended := AmendRules(f.Rules, sources, dune, defaultConfig())
+	checkOutput(t, ruleNames(amended[:2]), []string{"version_gen", "data_gen"})
+	var gen []*rule.Rule
+	for _, result := range amended {
+		gen = append(gen, result.rule)
+	}
+	var stale []string
+	for _, r := range staleRules(f, gen, defaultConfig().naming) {
+		stale = append(stale, r.Name())
+	}
+	checkOutput(t, stale, []string{"defs_gen", "defs"})
+	var warnings bytes.Buffer
+	log.SetOutput(&warnings)
+	shell := decodeDuneRules(parseDune(`(rule
+ (targets header.txt)
+ (deps version.txt)
+ (action (bash "cat version.txt notes.md > header.txt && %{bin:date} >> header.txt")))`))
+	log.SetOutput(os.Stderr)
+	checkOutput(t, shell[0].cmd, "cat $(location :version.txt) notes.md > $(location :header.txt) && date >> $(location :header.txt)")
+	for _, warning := range []string{"%{bin:date} is looked up in the PATH", "the relative path notes.md doesn't exist"} {
+		if !strings.Contains(warnings.String(), warning) {
+			t.Fatalf("missing warning %q: %s", warning, warnings.String())
+		}
+	}
+}
+
+func TestCopyFiles(t *testing.T) {
+	root := t.TempDir()
+	files := []string{"common/util.ml", "common/util.mli", "common/notes.txt", "app/main.ml", "_build/app/main.ml", "bench/main.ml"}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dune := filepath.Join(root, "app", "dune")
+	code := "(library (name app))\n(copy_files# ../common/*.{ml,mli})\n(rule (targets util.txt) (action (system \"date > %{targets}\")))"
+	// The copies in directories that Dune ignores aren't considered
+	for _, dir := range []string{"app", "_build/app", "bench"} {
+		if err := os.WriteFile(filepath.Join(root, dir, "dune"), []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "dune"), []byte("(dirs :standard \\ bench)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	util := filepath.Join(root, "common", "util")
+	checkOutput(t, duneGenerators(dune)["util"], Generator(Copy{ml: util + ".ml", mli: util + ".mli"}))
+	copied := copiedFiles(filepath.Join(root, "app"), decodeCopyFiles(parseDuneFile(dune)))
+	cp, exists := copyRule(root, "app", copied, defaultNaming)
+	if !exists {
+		t.Fatal("no rule for copy_files")
+	}
+	checkOutput(t, cp.srcs, []string{"//common:copied_by_app"})
+	checkOutput(t, cp.targets, []string{"util.ml", "util.mli"})
+	conf := defaultConfig()
+	conf.copies = scanCopiedFiles(root)
+	checkOutput(t, conf.copies, map[string][]CopiedFiles{"common": {{"app", []string{"util.ml", "util.mli"}}}})
+	exported := copySources("common", conf)[0].rule
+	checkOutput(t, exported.Name(), "copied_by_app")
+	checkOutput(t, exported.AttrStrings("srcs"), []string{":util.ml", ":util.mli"})
+	checkOutput(t, exported.AttrStrings("visibility"), []string{"//app:__pkg__"})
+	stale := staleRules(buildFile(t, copySources("common", conf)), nil, conf.naming)
+	checkOutput(t, stale[0].Name(), "copied_by_app")
+	conf.repoRoot = root
+	checkOutput(t, ruleNames(genrules(duneRules(parseDuneFile(dune), dune, conf), conf)), []string{"util_gen", "util_gen_2"})
+	for _, outside := range []string{filepath.Dir(root), filepath.Join(filepath.Dir(root), "util.ml")} {
+		if _, inRepo := filePackage(root, outside); inRepo {
+			t.Fatalf("%s was considered to be in the repository", outside)
+		}
+	}
+}
+
+const stubsDune = `(library
+ (name ffi)
+ (public_name ffi-lib)
+ (foreign_stubs (language c) (names a b) (flags :standard -O2))
+ (c_library_flags -lm)
+ (foreign_archives ext))`
+
+// The `cc_deps` of the library `name`, resolved from the stubs in the index.
+func resolvedStubs(t *testing.T, results []RuleResult, name string, backend Backend) []string {
+	c := config.New()
+	configure(c, "", nil)
+	getConfig(c).backend = backend
+	lang := NewLanguage().(*okapiLang)
+	ix := resolve.NewRuleIndex(func(*rule.Rule, string) resolve.Resolver { return lang })
+	f := buildFile(t, results)
+	for _, r := range f.Rules {
+		ix.AddRule(c, r, f)
+	}
+	ix.Finish()
+	lib := findResult(t, results, name).rule
+	lang.Resolve(c, ix, nil, lib, nil, label.New("", "", lib.Name()))
+	return lib.AttrStrings("cc_deps")
+}
+
+func TestForeignStubs(t *testing.T) {
+	conf := defaultConfig()
+	conf.backend = RulesOcamlBackend{}
+	spec := duneToSpec(decodeDuneConfig("ffi", parseDune(stubsDune), defaultProject))
+	results := multilib(spec, Deps{"ffi": src("ffi", false)}, conf)
+	stubs := findResult(t, results, "ffi_stubs").rule
+	checkOutput(t, stubs.AttrStrings("srcs"), []string{":a.c", ":b.c", ":libext.a"})
+	checkOutput(t, stubs.AttrStrings("copts"), []string{"-O2"})
+	checkOutput(t, stubs.AttrStrings("linkopts"), []string{"-lm"})
+	checkOutput(t, findResult(t, results, "#Ffi").rule.Attr("cc_deps"), nil)
+	checkOutput(t, resolvedStubs(t, results, "#Ffi", conf.backend), []string{":ffi_stubs"})
+	f := buildFile(t, results)
+	amended := AmendRules(f.Rules, Deps{"ffi": src("ffi", false)}, "", conf)
+	checkOutput(t, findResult(t, amended, "ffi_stubs").rule.AttrStrings("srcs"), []string{":a.c", ":b.c", ":libext.a"})
+	checkOutput(t, resolvedStubs(t, amended, "#Ffi", conf.backend), []string{":ffi_stubs"})
+}
+
+const mixedStubsDune = `(library
+ (name ffi)
+ (c_names legacy)
+ (foreign_stubs (language c) (names a))
+ (foreign_stubs (language cxx) (names b) (flags -std=c++17))
+ (foreign_stubs (language c) (names c)))`
+
+func TestMixedForeignStubs(t *testing.T) {
+	conf := defaultConfig()
+	conf.backend = RulesOcamlBackend{}
+	spec := duneToSpec(decodeDuneConfig("ffi", parseDune(mixedStubsDune), defaultProject))
+	results := multilib(spec, Deps{"ffi": src("ffi", false)}, conf)
+	checkOutput(t, findResult(t, results, "ffi_stubs").rule.AttrStrings("srcs"), []string{":legacy.c", ":a.c", ":c.c"})
+	cxx := findResult(t, results, "ffi_1_stubs").rule
+	checkOutput(t, cxx.AttrStrings("srcs"), []string{":b.cpp"})
+	checkOutput(t, cxx.AttrStrings("copts"), []string{"-std=c++17"})
+	checkOutput(t, resolvedStubs(t, results, "#Ffi", conf.backend), []string{":ffi_stubs", ":ffi_1_stubs"})
+	amended := AmendRules(buildFile(t, results).Rules, Deps{"ffi": src("ffi", false)}, "", conf)
+	checkOutput(t, findResult(t, amended, "ffi_1_stubs").rule.AttrStrings("srcs"), []string{":b.cpp"})
+	checkOutput(t, resolvedStubs(t, amended, "#Ffi", conf.backend), []string{":ffi_stubs", ":ffi_1_stubs"})
+	var stale []string
+	for _, r := range staleRules(buildFile(t, results), nil, conf.naming) {
+		if r.Kind() == "cc_library" {
+			stale = append(stale, r.Name())
+		}
+	}
+	checkOutput(t, stale, []string{"ffi_stubs", "ffi_1_stubs"})
+}
+
+const inlineTestsDune = `(library
+ (name calc)
+ (inline_tests (deps data.txt) (flags -verbose))
+ (preprocess (pps ppx_inline_test)))`
+
+func TestInlineTests(t *testing.T) {
+	conf := defaultConfig()
+	sources := Deps{"calc": src("calc", false)}
+	spec := duneToSpec(decodeDuneConfig("calc", parseDune(inlineTestsDune), defaultProject))
+	results := multilib(spec, sources, conf)
+	runner := findResult(t, results, "inline_test_runner_calc")
+	checkOutput(t, runner.rule.AttrString("struct"), ":inline_test_runner_calc.ml")
+	checkOutput(t, runner.deps, []string{"ppx_inline_test.runtime-lib"})
+	checkOutput(t, findResult(t, results, "calc").rule.AttrStrings("ppx_args"), []string{"-inline-test-lib", "calc"})
+	tests := findResult(t, results, "calc_inline_tests")
+	checkOutput(t, tests.deps, []string{"ppx_inline_test.runner.lib"})
+	test := tests.rule
+	checkOutput(t, test.Kind(), "ocaml_test")
+	checkOutput(t, test.AttrString("main"), "inline_test_runner_calc")
+	checkOutput(t, test.AttrStrings("deps"), []string{":#Calc"})
+	checkOutput(t, test.AttrStrings("opts"), []string{"-linkall"})
+	checkOutput(t, test.AttrStrings("args"), []string{"inline-test-runner", "calc", "-verbose"})
+	checkOutput(t, test.AttrStrings("data"), []string{":data.txt"})
+	f := buildFile(t, results)
+	var gen []*rule.Rule
+	amended := AmendRules(f.Rules, sources, "", conf)
+	for _, result := range amended {
+		gen = append(gen, result.rule)
+	}
+	checkOutput(t, len(staleRules(f, gen, conf.naming)), 0)
+	checkOutput(t, findResult(t, amended, "calc").rule.AttrStrings("ppx_args"), []string{"-inline-test-lib", "calc"})
+	globDune := strings.Replace(inlineTestsDune, "(deps data.txt)", "(deps data.txt (glob_files *.{txt,json}) (alias runtest))", 1)
+	var warnings bytes.Buffer
+	log.SetOutput(&warnings)
+	results = multilib(duneToSpec(decodeDuneConfig("calc", parseDune(globDune), defaultProject)), sources, conf)
+	log.SetOutput(os.Stderr)
+	data := findResult(t, results, "calc_inline_tests").rule.Attr("data")
+	checkOutput(t, bzl.FormatString(data), "[\":data.txt\"] + glob([\n    \"*.txt\",\n    \"*.json\",\n])")
+	if !strings.Contains(warnings.String(), "skipping unsupported dependency of inline_tests") {
+		t.Fatalf("expected a warning about the alias dependency, got %q", warnings.String())
+	}
+}
+
+const preprocessDune = `(library
+ (name calc)
+ (preprocessor_deps config.txt (file extra.txt))
+ (preprocess
+  (per_module
+   ((pps ppx_a ppx_b -check -- -cookie "x=1") lexer parser)
+   ((action (run %{bin:cppo} -V OCAML:%{ocaml_version} %{input-file})) compat)
+   ((action (run %{bin:cppo} -n %{input-file})) Calc))))`
+
+func TestPreprocess(t *testing.T) {
+	conf := defaultConfig()
+	conf.ocamlVersion = "4.14.0"
+	sources := Deps{
+		"calc":   src("calc", false, "parser"),
+		"compat": src("compat", false),
+		"parser": src("parser", false),
+		"util":   src("util", false),
+	}
+	spec := duneToSpec(decodeDuneConfig("calc", parseDune(preprocessDune), defaultProject))
+	results := multilib(spec, sources, conf)
+	parser := findResult(t, results, "parser").rule
+	checkOutput(t, parser.Kind(), "ppx_module")
+	checkOutput(t, parser.AttrStrings("ppx_args"), []string{"-check", "-cookie", "x=1"})
+	checkOutput(t, parser.AttrStrings("ppx_data"), []string{":config.txt", ":extra.txt"})
+	driver := findResult(t, results, removeColon(parser.AttrString("ppx"))).rule
+	checkOutput(t, driver.AttrStrings("deps_opam"), []string{"ppx_a", "ppx_b"})
+	checkOutput(t, findResult(t, results, "compat").rule.AttrStrings("opts"), []string{"-pp", "cppo -V 'OCAML:4.14.0'"})
+	calc := findResult(t, results, "calc").rule
+	checkOutput(t, calc.Kind(), "ocaml_module")
+	checkOutput(t, calc.AttrStrings("opts"), []string{"-pp", "cppo -n"})
+	checkOutput(t, ruleConfigOr(calc, "path_tools", ""), "cppo")
+	checkOutput(t, findResult(t, results, "util").rule.Attr("ppx"), nil)
+	f := buildFile(t, results)
+	var amended []*rule.Rule
+	for _, result := range AmendRules(f.Rules, sources, "", conf) {
+		amended = append(amended, result.rule)
+	}
+	checkOutput(t, len(staleRules(f, amended, conf.naming)), 0)
+	for _, r := range amended {
+		if r.Name() == "parser" {
+			checkOutput(t, r.AttrString("ppx"), parser.AttrString("ppx"))
+			checkOutput(t, r.AttrStrings("ppx_args"), parser.AttrStrings("ppx_args"))
+		} else if r.Name() == "calc" {
+			checkOutput(t, r.AttrStrings("opts"), []string{"-pp", "cppo -n"})
+		}
+	}
+	conf.ocamlVersion = ""
+	var warnings bytes.Buffer
+	log.SetOutput(&warnings)
+	results = multilib(spec, sources, conf)
+	log.SetOutput(os.Stderr)
+	checkOutput(t, findResult(t, results, "compat").rule.Attr("opts"), nil)
+	checkOutput(t, findResult(t, results, "calc").rule.AttrStrings("opts"), []string{"-pp", "cppo -n"})
+	if !strings.Contains(warnings.String(), "skipping the preprocessing action of compat") {
+		t.Fatalf("expected a warning about %%{ocaml_version}, got %q", warnings.String())
+	}
+}
+
+const modesDune = `(executable
+ (name main)
+ (modes byte exe (byte_complete exe) js)
+ (flags -w +a)
+ (ocamlc_flags -g)
+ (ocamlopt_flags -O3)
+ (link_flags -cclib -lm))`
+
+func TestModes(t *testing.T) {
+	conf := defaultConfig()
+	sources := Deps{"main": src("main", false, "util"), "util": src("util", false)}
+	results := multilib(duneToSpec(decodeDuneConfig("app", parseDune(modesDune), defaultProject)), sources, conf)
+	main := findResult(t, results, "exe-main").rule
+	checkOutput(t, main.AttrString("mode"), "bytecode")
+	checkOutput(t, main.AttrStrings("opts"), []string{"-cclib", "-lm"})
+	checkOutput(t, findResult(t, results, "exe-main.exe").rule.AttrString("mode"), "native")
+	complete := findResult(t, results, "exe-main.bc.exe").rule
+	checkOutput(t, complete.AttrStrings("opts"), []string{"-cclib", "-lm", "-output-complete-exe"})
+	checkOutput(t, complete.AttrStrings("deps"), []string{":util"})
+	util := findResult(t, results, "util").rule
+	flags, modeFlags := existingOpts(util)
+	checkOutput(t, flags, []string{"-w", "+a"})
+	checkOutput(t, modeFlags, ModeFlags{byte: []string{"-g"}, native: []string{"-O3"}})
+	f := buildFile(t, results)
+	amended := AmendRules(f.Rules, sources, "", conf)
+	checkOutput(t, ruleNames(amended), ruleNames(results))
+	checkOutput(t, findResult(t, amended, "exe-main.bc.exe").rule.AttrStrings("opts"), complete.AttrStrings("opts"))
+	flags, modeFlags = existingOpts(findResult(t, amended, "util").rule)
+	checkOutput(t, flags, []string{"-w", "+a"})
+	checkOutput(t, modeFlags, ModeFlags{byte: []string{"-g"}, native: []string{"-O3"}})
+}
+
+const enabledIfDune = `(library
+ (name unix_only)
+ (modules unix_only lexer)
+ (preprocess (pps ppx_inline_test))
+ (inline_tests)
+ (foreign_stubs (language c) (names unix_stubs))
+ (enabled_if (and (<> %{os_type} Win32) (>= %{ocaml_version} 4.14))))
+(executable
+ (name main)
+ (modules main)
+ (enabled_if (or (= %{system} linux) (= macosx %{system}))))
+(rule
+ (targets gen.txt)
+ (enabled_if (= %{architecture} arm64))
+ (action (with-stdout-to %{targets} (run echo x))))
+(test
+ (name old)
+ (modules old)
+ (enabled_if (< %{ocaml_version} 4.08)))`
+
+func TestEnabledIf(t *testing.T) {
+	conf := defaultConfig()
+	conf.ocamlVersion = "4.14.1"
+	sources := Deps{
+		"unix_only": src("unix_only", false),
+		"lexer":     {name: "lexer", generator: Lexer{}},
+		"main":      src("main", false),
+		"old":       src("old", false),
+	}
+	results := multilib(duneToSpec(decodeDuneConfig("pkg", parseDune(enabledIfDune), defaultProject)), sources, conf)
+	windows := rule.SelectStringListValue{"@platforms//os:windows": {incompatible}, defaultCondition: {}}
+	for _, name := range []string{
+		"unix_only", "#Unix_only", "lexer_ml", "ppx_set-0", "unix_only_stubs", "inline_test_runner_unix_only_gen",
+		"inline_test_runner_unix_only", "unix_only_inline_tests",
+	} {
+		checkOutput(t, findResult(t, results, name).rule.Attr("target_compatible_with"), rule.ExprFromValue(windows))
+	}
+	unixOnly := rule.SelectStringListValue{
+		"@platforms//os:linux": {},
+		"@platforms//os:macos": {},
+		defaultCondition:       {incompatible},
+	}
+	checkOutput(t, findResult(t, results, "exe-main").rule.Attr("target_compatible_with"), rule.ExprFromValue(unixOnly))
+	checkOutput(t, findResult(t, results, "old").rule.AttrStrings("target_compatible_with"), []string{incompatible})
+	gen := findResult(t, results, "gen_gen").rule
+	checkOutput(t, gen.AttrStrings("target_compatible_with"), []string{"@platforms//cpu:aarch64"})
+	conf.ocamlVersion = ""
+	results = multilib(duneToSpec(decodeDuneConfig("pkg", parseDune(enabledIfDune), defaultProject)), sources, conf)
+	checkOutput(t, findResult(t, results, "old").rule.Attr("target_compatible_with"), nil)
+}
+
+const duneProject = `(lang dune 3.0)
+(implicit_transitive_deps false)
+(package
+ (name app)
+ (depends (ocaml (>= 4.14)) cmdliner))`
+
+func TestDuneProject(t *testing.T) {
+	project := decodeDuneProject(parseSexp(duneProject))
+	checkOutput(t, project.lang, [2]int{3, 0})
+	checkOutput(t, project.implicitTransitiveDeps, false)
+	checkOutput(t, project.executablesImplicitEmptyIntf, true)
+	checkOutput(t, project.packages, []DunePackage{{"app", []string{"ocaml", "cmdliner"}}})
+	conf := defaultConfig()
+	sources := Deps{"main": src("main", false)}
+	dune := parseDune("(executable (name main) (public_name app))")
+	results := multilib(duneToSpec(decodeDuneConfig("app", dune, project)), sources, conf)
+	gen := findResult(t, results, "main_intf_gen").rule
+	checkOutput(t, gen.AttrStrings("outs"), []string{"main.mli"})
+	checkOutput(t, findResult(t, results, "main").rule.AttrString("sig"), ":main__sig")
+	amended := AmendRules(buildFile(t, results).Rules, sources, "", conf)
+	checkOutput(t, ruleNames(amended), ruleNames(results))
+}
+
+const envDune = `(env
+ (dev (flags (:standard -w +a)))
+ (release (ocamlopt_flags (-O3))))`
+
+func TestEnv(t *testing.T) {
+	conf := defaultConfig()
+	stanza, _ := decodeEnv(parseDune(envDune))
+	conf.env = conf.env.extend(stanza, "", conf.naming, nil)
+	settings := profileSettings("", conf)
+	checkOutput(t, ruleNames(settings), []string{
+		"profile_dev",
+		"profile_dev_bytecode",
+		"profile_release",
+		"profile_release_bytecode",
+	})
+	checkOutput(t, len(profileSettings("sub", conf)), 0)
+	sub, _ := decodeEnv(parseDune("(env (_ (flags (:standard -g))))"))
+	subConf := conf.clone()
+	subConf.env = conf.env.extend(sub, "sub", conf.naming, nil)
+	checkOutput(t, subConf.env.profile("dev").flags, []string{"-w", "+a", "-g"})
+	checkOutput(t, subConf.env.profile("release").flags, []string{"-g"})
+	checkOutput(t, len(profileSettings("sub", subConf)), 0)
+	sources := Deps{"a": src("a", false), "b": src("b", false)}
+	dune := parseDune("(library (name a) (modules a) (flags (:standard -open B))) (library (name b) (modules b) (flags (-w -a)) (ocamlopt_flags ()))")
+	results := multilib(duneToSpec(decodeDuneConfig("pkg", dune, defaultProject)), sources, conf)
+	opts := rule.SelectStringListValue{
+		"//:profile_dev_bytecode":     {"-w", "+a", "-open", "B"},
+		"//:profile_release":          {"-open", "B", "-O3"},
+		"//:profile_release_bytecode": {"-open", "B"},
+		defaultCondition:              {"-w", "+a", "-open", "B"},
+	}
+	expected := bzl.FormatString(rule.ExprFromValue(opts))
+	checkOutput(t, bzl.FormatString(findResult(t, results, "a").rule.Attr("opts")), expected)
+	checkOutput(t, findResult(t, results, "b").rule.AttrStrings("opts"), []string{"-w", "-a"})
+	amended := AmendRules(buildFile(t, results).Rules, sources, "", conf)
+	checkOutput(t, bzl.FormatString(findResult(t, amended, "a").rule.Attr("opts")), expected)
+	duneFile := filepath.Join(t.TempDir(), "dune")
+	changed := "(library (name a) (modules a) (flags (:standard -open C))) (library (name b) (modules b))"
+	if err := os.WriteFile(duneFile, []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	amended = AmendRules(buildFile(t, results).Rules, sources, duneFile, conf)
+	opts["//:profile_dev_bytecode"] = []string{"-w", "+a", "-open", "C"}
+	opts["//:profile_release"] = []string{"-open", "C", "-O3"}
+	opts["//:profile_release_bytecode"] = []string{"-open", "C"}
+	opts[defaultCondition] = []string{"-w", "+a", "-open", "C"}
+	checkOutput(t, bzl.FormatString(findResult(t, amended, "a").rule.Attr("opts")), bzl.FormatString(rule.ExprFromValue(opts)))
+	standard := rule.SelectStringListValue{
+		"//:profile_dev_bytecode":     {"-w", "+a"},
+		"//:profile_release":          {"-O3"},
+		"//:profile_release_bytecode": {},
+		defaultCondition:              {"-w", "+a"},
+	}
+	checkOutput(t, bzl.FormatString(findResult(t, amended, "b").rule.Attr("opts")), bzl.FormatString(rule.ExprFromValue(standard)))
+}
+
+const privateDune = `(library
+ (name lib)
+ (private_modules impl)
+ (modules_without_implementation types))`
+
+func TestPrivateModules(t *testing.T) {
+	conf := defaultConfig()
+	types := Source{name: "types", virtual: true, generator: NoGenerator{}}
+	sources := Deps{"api": src("api", false, "impl", "types"), "impl": src("impl", false, "types"), "types": types}
+	results := multilib(duneToSpec(decodeDuneConfig("lib", parseDune(privateDune), defaultProject)), sources, conf)
+	lib := findResult(t, results, "#Lib").rule
+	checkOutput(t, lib.AttrStrings("submodules"), []string{":api", ":types"})
+	checkOutput(t, lib.AttrStrings("deps"), []string{":impl"})
+	checkOutput(t, ruleConfigOr(lib, "private_modules", ""), "impl")
+	checkOutput(t, findResult(t, results, "impl").rule.Kind(), "ocaml_module")
+	sig := findResult(t, results, "types").rule
+	checkOutput(t, sig.Kind(), "ocaml_signature")
+	checkOutput(t, sig.AttrString("src"), ":types.mli")
+	checkOutput(t, findResult(t, results, "impl").rule.AttrStrings("deps"), []string{":types"})
+	amended := AmendRules(buildFile(t, results).Rules, sources, "", conf)
+	checkOutput(t, ruleNames(amended), ruleNames(results))
+	checkOutput(t, findResult(t, amended, "#Lib").rule.AttrStrings("submodules"), []string{":api", ":types"})
+	checkOutput(t, findResult(t, amended, "#Lib").rule.AttrStrings("deps"), []string{":impl"})
+	checkOutput(t, ruleConfigOr(findResult(t, amended, "#Lib").rule, "private_modules", ""), "impl")
+}
+
+func evalFlags(t *testing.T, code string, standard []string) []string {
+	set, err := decodeOrderedSet(parseSexp(code)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return evalOrderedSet(set, standard)
+}
+
+func TestOrderedSet(t *testing.T) {
+	standard := []string{"-g", "-short-paths"}
+	checkOutput(t, evalFlags(t, `(:standard -w +a \ -g)`, standard), []string{"-short-paths", "-w", "+a"})
+	checkOutput(t, evalFlags(t, `(a (b c) \ b \ c)`, nil), []string{"a"})
+	checkOutput(t, evalFlags(t, `((:standard \ a) b)`, []string{"a", "c"}), []string{"c", "b"})
+	modules := func(field string) ModuleSpec {
+		return decodeDuneConfig("lib", parseDune("(library (name lib) "+field+")"), defaultProject).modules[0]
+	}
+	checkOutput(t, modules(""), AutoModules{})
+	checkOutput(t, modules("(modules)"), ConcreteModules{nil})
+	checkOutput(t, modules(`(modules :standard \ a b)`), ExcludeModules{[]string{"a", "b"}, nil})
+	checkOutput(t, modules(`(modules (:standard \ a) b)`), ExcludeModules{[]string{"a"}, []string{"b"}})
+	checkOutput(t, modules(`(modules :standard \ (:standard \ a b) b)`), ConcreteModules{[]string{"a"}})
+	checkOutput(t, modules(`(modules Foo (:standard \ Bar))`), ExcludeModules{[]string{"bar"}, []string{"foo"}})
+	kind := decodeDuneConfig("lib", parseDune("(library (name lib) (private_modules Impl) (modules_without_implementation Types))"), defaultProject).components[0].kind.(LibSpec)
+	checkOutput(t, kind.privateModules, []string{"impl"})
+	checkOutput(t, kind.noImpl, []string{"types"})
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "flags.sexp"), []byte("(-O3 -unboxed-types)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	duneFile := filepath.Join(dir, "dune")
+	code := "(library (name a) (modules a) (flags (:standard (:include flags.sexp))))\n" +
+		"(library (name b) (modules b) (flags (:include generated.sexp)))"
+	if err := os.WriteFile(duneFile, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := defaultConfig()
+	conf.standardFlags = []string{"-g"}
+	sources := Deps{"a": src("a", false), "b": src("b", false)}
+	var warnings bytes.Buffer
+	log.SetOutput(&warnings)
+	results := multilib(duneToSpec(decodeDuneConfig("pkg", parseDuneFile(duneFile), defaultProject)), sources, conf)
+	log.SetOutput(os.Stderr)
+	checkOutput(t, findResult(t, results, "a").rule.AttrStrings("opts"), []string{"-g", "-O3", "-unboxed-types"})
+	checkOutput(t, findResult(t, results, "b").rule.Attr("opts"), nil)
+	warning := "WARNING: dune library b: ignoring (:include generated.sexp) in flags, since the file is generated by a rule"
+	if !strings.Contains(warnings.String(), warning) {
+		t.Fatalf("missing warning: %s", warnings.String())
+	}
+}
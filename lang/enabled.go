@@ -0,0 +1,332 @@
+package okapi
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// The platforms a stanza is built for, which are specified by `target_compatible_with`.
+type Compatibility interface {
+	// The value of `target_compatible_with`, or nil if the stanza is enabled everywhere
+	constraints(conf *Config) interface{}
+}
+
+// The `enabled_if` field of a Dune stanza.
+// It is translated when generating the rules, since comparisons with `%{ocaml_version}` depend on the config.
+type EnabledIf struct {
+	stanza string
+	cond   SexpNode
+}
+
+// The `target_compatible_with` of existing modules, which is used for the other rules of the library or executable.
+type ExistingCompatibility struct {
+	expr bzl.Expr
+}
+
+const incompatible = "@platforms//:incompatible"
+
+// The values of `%{system}` mapped to the constraints of the platforms repository.
+var systemConstraints = map[string]string{
+	"linux":   "@platforms//os:linux",
+	"macosx":  "@platforms//os:macos",
+	"freebsd": "@platforms//os:freebsd",
+	"openbsd": "@platforms//os:openbsd",
+	"netbsd":  "@platforms//os:netbsd",
+	"win32":   "@platforms//os:windows",
+	"win64":   "@platforms//os:windows",
+	"mingw":   "@platforms//os:windows",
+	"mingw64": "@platforms//os:windows",
+	"cygwin":  "@platforms//os:windows",
+}
+
+// The values of `%{architecture}` mapped to the constraints of the platforms repository.
+var architectureConstraints = map[string]string{
+	"amd64": "@platforms//cpu:x86_64",
+	"i386":  "@platforms//cpu:x86_32",
+	"arm":   "@platforms//cpu:armv7",
+	"arm64": "@platforms//cpu:aarch64",
+	"power": "@platforms//cpu:ppc",
+	"riscv": "@platforms//cpu:riscv64",
+	"s390x": "@platforms//cpu:s390x",
+}
+
+// A condition on the target platform, which is either a constant, a constraint or a combination of conditions.
+type platformCond interface{}
+type constCond bool
+type constraintCond struct {
+	label   string
+	negated bool
+}
+type andCond []platformCond
+type orCond []platformCond
+
+var versionComponent = regexp.MustCompile(`\d+`)
+
+// Compare versions like `4.14.1` by their numeric components.
+func compareVersions(a string, b string) int {
+	as := versionComponent.FindAllString(strings.SplitN(a, "+", 2)[0], -1)
+	bs := versionComponent.FindAllString(strings.SplitN(b, "+", 2)[0], -1)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := 0, 0
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func compareWith(op string, order int) bool {
+	switch op {
+	case "=":
+		return order == 0
+	case "<>":
+		return order != 0
+	case "<":
+		return order < 0
+	case ">":
+		return order > 0
+	case "<=":
+		return order <= 0
+	default:
+		return order >= 0
+	}
+}
+
+// The operator with its operands swapped.
+var mirrored = map[string]string{"=": "=", "<>": "<>", "<": ">", ">": "<", "<=": ">=", ">=": "<="}
+
+func constraintComparison(op string, label string, exists bool, value string) (platformCond, error) {
+	if !exists {
+		return nil, fmt.Errorf("unknown value %s", value)
+	}
+	if op != "=" && op != "<>" {
+		return nil, fmt.Errorf("unsupported operator %s", op)
+	}
+	return constraintCond{label, op == "<>"}, nil
+}
+
+func comparison(op string, left string, right string, conf *Config) (platformCond, error) {
+	variable := duneVariable.FindStringSubmatch(left)
+	if variable == nil || variable[0] != left {
+		if variable = duneVariable.FindStringSubmatch(right); variable == nil || variable[0] != right {
+			return nil, fmt.Errorf("no variable in comparison %s %s %s", left, op, right)
+		}
+		op, right = mirrored[op], left
+	}
+	switch variable[1] {
+	case "system":
+		label, exists := systemConstraints[right]
+		return constraintComparison(op, label, exists, right)
+	case "architecture":
+		label, exists := architectureConstraints[right]
+		return constraintComparison(op, label, exists, right)
+	case "os_type":
+		cond, err := constraintComparison(op, systemConstraints["win32"], right == "Win32" || right == "Unix", right)
+		if c, isConstraint := cond.(constraintCond); isConstraint && right == "Unix" {
+			c.negated = !c.negated
+			cond = c
+		}
+		return cond, err
+	case "ocaml_version":
+		if conf.ocamlVersion == "" {
+			return nil, fmt.Errorf("%%{ocaml_version} requires the directive `%s`", ocamlVersionDirective)
+		}
+		return constCond(compareWith(op, compareVersions(conf.ocamlVersion, right))), nil
+	default:
+		return nil, fmt.Errorf("unsupported variable %s", variable[0])
+	}
+}
+
+func negate(cond platformCond) (platformCond, error) {
+	switch c := cond.(type) {
+	case constCond:
+		return !c, nil
+	case constraintCond:
+		return constraintCond{c.label, !c.negated}, nil
+	default:
+		return nil, fmt.Errorf("unsupported negation of %#v", cond)
+	}
+}
+
+// Translate Dune's boolean language.
+func blang(node SexpNode, conf *Config) (platformCond, error) {
+	if s, isString := node.(SexpString); isString {
+		if value, err := strconv.ParseBool(s.Content); err == nil {
+			return constCond(value), nil
+		}
+		return nil, fmt.Errorf("unsupported condition %s", s.Content)
+	}
+	elems, err := node.List()
+	if err != nil || len(elems) == 0 {
+		return nil, fmt.Errorf("invalid condition %#v", node)
+	}
+	op, err := elems[0].String()
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %#v", node)
+	}
+	args := elems[1:]
+	switch op {
+	case "and", "or":
+		var result []platformCond
+		for _, arg := range args {
+			cond, err := blang(arg, conf)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, cond)
+		}
+		if op == "and" {
+			return andCond(result), nil
+		}
+		return orCond(result), nil
+	case "not":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid condition %#v", node)
+		}
+		cond, err := blang(args[0], conf)
+		if err != nil {
+			return nil, err
+		}
+		return negate(cond)
+	case "=", "<>", "<", ">", "<=", ">=":
+		operands, err := sexpStrings(SexpList{args})
+		if err != nil || len(operands) != 2 {
+			return nil, fmt.Errorf("invalid comparison %#v", node)
+		}
+		return comparison(op, operands[0], operands[1], conf)
+	default:
+		return nil, fmt.Errorf("unsupported operator %s", op)
+	}
+}
+
+// Remove constants from conjunctions and disjunctions.
+func simplify(cond platformCond) platformCond {
+	var parts []platformCond
+	var and bool
+	if c, isAnd := cond.(andCond); isAnd {
+		parts, and = c, true
+	} else if c, isOr := cond.(orCond); isOr {
+		parts = c
+	} else {
+		return cond
+	}
+	var result []platformCond
+	for _, part := range parts {
+		part = simplify(part)
+		if value, isConst := part.(constCond); isConst {
+			if bool(value) != and {
+				return value
+			}
+		} else {
+			result = append(result, part)
+		}
+	}
+	if len(result) == 0 {
+		return constCond(and)
+	} else if len(result) == 1 {
+		return result[0]
+	} else if and {
+		return andCond(result)
+	}
+	return orCond(result)
+}
+
+// The labels of the conditions, if they are all constraints that aren't negated.
+func positiveLabels(conds []platformCond) ([]string, bool) {
+	var result []string
+	for _, cond := range conds {
+		c, isConstraint := cond.(constraintCond)
+		if !isConstraint || c.negated {
+			return nil, false
+		}
+		result = append(result, c.label)
+	}
+	return result, true
+}
+
+// Conjunctions of constraints are expressed as lists, negations and disjunctions by selecting `incompatible` for the
+// other platforms.
+func compatibilityValue(cond platformCond) (interface{}, error) {
+	switch c := simplify(cond).(type) {
+	case constCond:
+		if c {
+			return nil, nil
+		}
+		return []string{incompatible}, nil
+	case constraintCond:
+		if c.negated {
+			return rule.SelectStringListValue{c.label: {incompatible}, defaultCondition: {}}, nil
+		}
+		return []string{c.label}, nil
+	case andCond:
+		if labels, positive := positiveLabels(c); positive {
+			return labels, nil
+		}
+	case orCond:
+		if labels, positive := positiveLabels(c); positive {
+			value := rule.SelectStringListValue{defaultCondition: {incompatible}}
+			for _, label := range labels {
+				value[label] = []string{}
+			}
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported combination of conditions")
+}
+
+// Conditions that can't be translated are reported, and the stanza is treated as enabled.
+func (e EnabledIf) constraints(conf *Config) interface{} {
+	cond, err := blang(e.cond, conf)
+	var value interface{}
+	if err == nil {
+		value, err = compatibilityValue(cond)
+	}
+	if err != nil {
+		log.Printf("dune %s: ignoring enabled_if: %s: %#v", e.stanza, err, e.cond)
+		return nil
+	}
+	return value
+}
+
+func (c ExistingCompatibility) constraints(*Config) interface{} { return c.expr }
+
+func decodeEnabledIf(data SexpComponent) Compatibility {
+	raw, exists := data.data.Values["enabled_if"]
+	if !exists {
+		return nil
+	}
+	cond := raw
+	if l, isList := raw.(SexpList); isList && len(l.Sub) == 1 {
+		cond = l.Sub[0]
+	}
+	return EnabledIf{data.name, cond}
+}
+
+func compatibilityAttr(r *rule.Rule, value interface{}) {
+	if value != nil {
+		r.SetAttr("target_compatible_with", value)
+	}
+}
+
+// The constraints of a stanza apply to all rules generated for it, like its stubs, parsers and ppx executables.
+func withCompatibility(results []RuleResult, value interface{}) []RuleResult {
+	for _, result := range results {
+		compatibilityAttr(result.rule, value)
+	}
+	return results
+}
@@ -0,0 +1,282 @@
+package okapi
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// The flags of a Dune profile, from the `env` stanzas of a directory and its parents.
+type EnvProfile struct {
+	flags     []string
+	modeFlags ModeFlags
+}
+
+// The fields of each profile in an `env` stanza, where `_` applies to the profiles that aren't listed.
+// The `:standard` of a field refers to the value of the parent directory.
+type EnvStanza map[string]map[string]orderedSet
+
+// The profiles that apply to a directory.
+// Config settings for the profiles are generated in the topmost directory declaring them, and the modules' `opts`
+// select the flags of the profile that is matched by `--define=profile=<name>`.
+type Env struct {
+	profiles map[string]EnvProfile
+	// The label of each profile's config setting
+	settings map[string]string
+}
+
+// Dune builds in the `dev` profile unless told otherwise, so it is the default branch of the `select`.
+const defaultProfile = "dev"
+
+var envProfiles = []string{defaultProfile, "release"}
+
+var envFields = []string{"flags", "ocamlc_flags", "ocamlopt_flags"}
+
+// The flag fields of a stanza, which are evaluated with the flags of each profile as `:standard`.
+type FlagFields struct {
+	flags  orderedSet
+	byte   orderedSet
+	native orderedSet
+}
+
+func decodeFlagFields(lib SexpComponent) FlagFields {
+	return FlagFields{
+		flags:  lib.orderedSet("flags"),
+		byte:   lib.orderedSet("ocamlc_flags"),
+		native: lib.orderedSet("ocamlopt_flags"),
+	}
+}
+
+// Parse the `env` stanza of a dune file, if there is one.
+// Fields other than the compiler flags are ignored with a warning.
+func decodeEnv(conf SexpList) (EnvStanza, bool) {
+	for _, node := range conf.Sub {
+		env, isMap := node.(SexpMap)
+		if !isMap || env.Name != "env" {
+			continue
+		}
+		data := SexpComponent{"env", env}
+		result := make(EnvStanza)
+		for profile := range env.Values {
+			fields, _ := data.field(profile)
+			result[profile] = make(map[string]orderedSet)
+			for name := range fields.data.Values {
+				if contains(name, envFields) {
+					result[profile][name] = fields.orderedSet(name)
+				} else {
+					log.Printf("dune env: ignoring unsupported field %s of profile %s", name, profile)
+				}
+			}
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+func applyEnvFields(fields map[string]orderedSet, parent EnvProfile) EnvProfile {
+	result := parent
+	if field, exists := fields["flags"]; exists {
+		result.flags = evalOrderedSet(field, parent.flags)
+	}
+	if field, exists := fields["ocamlc_flags"]; exists {
+		result.modeFlags.byte = evalOrderedSet(field, parent.modeFlags.byte)
+	}
+	if field, exists := fields["ocamlopt_flags"]; exists {
+		result.modeFlags.native = evalOrderedSet(field, parent.modeFlags.native)
+	}
+	return result
+}
+
+func (env Env) profile(name string) EnvProfile {
+	if profile, exists := env.profiles[name]; exists {
+		return profile
+	}
+	return env.profiles["_"]
+}
+
+// The flags of a profile, which are the standard flags of the config if there are no `env` stanzas.
+func (conf *Config) profile(name string) EnvProfile {
+	if len(conf.env.profiles) == 0 {
+		return EnvProfile{flags: conf.standardFlags}
+	}
+	return conf.env.profile(name)
+}
+
+// The profiles with config settings, starting with `dev`.
+func (env Env) names() []string {
+	var result []string
+	for name := range env.settings {
+		if name != defaultProfile {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return append([]string{defaultProfile}, result...)
+}
+
+// Apply the `env` stanza of the directory `rel` to the profiles inherited from the parent directories.
+// Profiles that don't have a config setting yet get one in `rel`.
+// The topmost `env` stanza extends the standard flags.
+func (env Env) extend(stanza EnvStanza, rel string, naming Naming, standard []string) Env {
+	if len(env.profiles) == 0 {
+		env.profiles = map[string]EnvProfile{"_": {flags: standard}}
+	}
+	result := Env{make(map[string]EnvProfile), make(map[string]string)}
+	for name, label := range env.settings {
+		result.settings[name] = label
+	}
+	names := append([]string{"_"}, envProfiles...)
+	for name := range env.profiles {
+		names = appendUnique(names, name)
+	}
+	for name := range stanza {
+		names = appendUnique(names, name)
+	}
+	for _, name := range names {
+		fields, declared := stanza[name]
+		if !declared {
+			fields, declared = stanza["_"]
+		}
+		if declared {
+			result.profiles[name] = applyEnvFields(fields, env.profile(name))
+		} else {
+			result.profiles[name] = env.profile(name)
+		}
+		if _, exists := result.settings[name]; !exists && name != "_" {
+			result.settings[name] = "//" + rel + ":" + naming.profileTarget(name)
+		}
+	}
+	return result
+}
+
+func bytecodeSetting(label string) string { return label + "_bytecode" }
+
+// The config settings for the profiles declared in the directory `rel`.
+// Each profile is matched by `--define=profile=<name>`, and is combined with the bytecode mode in another setting,
+// since a `select` can't be nested.
+func profileSettings(rel string, conf *Config) []RuleResult {
+	var result []RuleResult
+	for _, name := range conf.env.names() {
+		label := conf.env.settings[name]
+		if !strings.HasPrefix(label, "//"+rel+":") {
+			continue
+		}
+		target := label[len(rel)+3:]
+		r := rule.NewRule("config_setting", target)
+		r.SetAttr("define_values", map[string]string{"profile": name})
+		result = append(result, RuleResult{r, nil})
+		byte := rule.NewRule("config_setting", bytecodeSetting(target))
+		byte.SetAttr("define_values", map[string]string{"profile": name})
+		byte.SetAttr("flag_values", map[string]string{conf.backend.modeSetting(): "bytecode"})
+		result = append(result, RuleResult{byte, nil})
+	}
+	return result
+}
+
+// The flags of the stanza in a profile, followed by the flags in `base` that Okapi adds, like `-pp`.
+func commonProfileFlags(base []string, profile EnvProfile, set SourceSet) []string {
+	if set.fields == nil {
+		return base
+	}
+	return append(evalOrderedSet(set.fields.flags, profile.flags), base...)
+}
+
+func modeProfileFlags(profile EnvProfile, set SourceSet) ModeFlags {
+	if set.fields == nil {
+		return set.modeFlags
+	}
+	return ModeFlags{
+		byte:   evalOrderedSet(set.fields.byte, profile.modeFlags.byte),
+		native: evalOrderedSet(set.fields.native, profile.modeFlags.native),
+	}
+}
+
+// The complete flags of a profile for each mode.
+func profileFlags(base []string, profile EnvProfile, set SourceSet) ModeFlags {
+	flags := commonProfileFlags(base, profile, set)
+	modeFlags := modeProfileFlags(profile, set)
+	return ModeFlags{
+		append(append([]string{}, flags...), modeFlags.byte...),
+		append(append([]string{}, flags...), modeFlags.native...),
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+func equalModeFlags(a ModeFlags, b ModeFlags) bool {
+	return equalStrings(a.byte, b.byte) && equalStrings(a.native, b.native)
+}
+
+// Set the final `opts` of a module, after the common flags have been added.
+// If the flags differ between the profiles, this is a `select` over the profiles and compilation modes, which
+// contains the complete flags for each combination, and otherwise the flags of `dev` with a `select` on the mode.
+// The `select` over the profiles only uses their config settings, since a setting for the mode would be ambiguous
+// with `profile_<name>_bytecode`, so the default has the native flags of `dev`.
+// Existing modules without a Dune stanza keep their `opts`.
+func setOpts(r *rule.Rule, set SourceSet, conf *Config) {
+	if set.profileOpts != nil {
+		r.SetAttr("opts", set.profileOpts)
+		return
+	}
+	base := r.AttrStrings("opts")
+	dev := profileFlags(base, conf.profile(defaultProfile), set)
+	byProfile := make(map[string]ModeFlags)
+	perMode := !equalStrings(dev.byte, dev.native)
+	for _, name := range conf.env.names()[1:] {
+		flags := profileFlags(base, conf.profile(name), set)
+		if !equalModeFlags(flags, dev) {
+			byProfile[name] = flags
+			perMode = perMode || !equalStrings(flags.byte, flags.native)
+		}
+	}
+	if len(byProfile) == 0 {
+		profile := conf.profile(defaultProfile)
+		if flags := commonProfileFlags(base, profile, set); len(flags) > 0 {
+			r.SetAttr("opts", flags)
+		}
+		setModeOpts(r, modeProfileFlags(profile, set), conf)
+		return
+	}
+	value := rule.SelectStringListValue{defaultCondition: dev.native}
+	if perMode {
+		value[bytecodeSetting(conf.env.settings[defaultProfile])] = dev.byte
+	}
+	for name, flags := range byProfile {
+		label := conf.env.settings[name]
+		value[label] = flags.native
+		if perMode {
+			value[bytecodeSetting(label)] = flags.byte
+		}
+	}
+	r.SetAttr("opts", value)
+}
+
+func isModeCondition(key string) bool {
+	return key == LegacyBackend{}.modeCondition(true) || key == RulesOcamlBackend{}.modeCondition(true)
+}
+
+// Whether `opts` is a `select` generated by `setOpts` for the profiles.
+func isProfileOpts(expr bzl.Expr) bool {
+	call, isCall := expr.(*bzl.CallExpr)
+	if !isCall || len(call.List) != 1 {
+		return false
+	}
+	if name, isIdent := call.X.(*bzl.Ident); !isIdent || name.Name != "select" {
+		return false
+	}
+	dict, isDict := call.List[0].(*bzl.DictExpr)
+	if !isDict {
+		return false
+	}
+	for _, kv := range dict.List {
+		if key, isString := kv.Key.(*bzl.StringExpr); isString && key.Value != defaultCondition && !isModeCondition(key.Value) {
+			return true
+		}
+	}
+	return false
+}
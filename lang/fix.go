@@ -0,0 +1,258 @@
+package okapi
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// A migration of build files generated by an earlier version of Okapi.
+// If `apply` is false, the file is only checked, and the result indicates whether it has to be migrated.
+type migration func(f *rule.File, dir string, conf *Config, apply bool) bool
+
+// Later migrations rely on the annotations added by `fixAnnotations` and `fixGeneratedTags`.
+var migrations = []migration{
+	fixModuleLabels,
+	fixAnnotations,
+	fixGeneratedTags,
+	fixSignatureNames,
+	fixObsoleteAttrs,
+}
+
+// Rewrite build files from older versions of Okapi to the current conventions.
+// Like the Go extension, this only modifies the file when running `gazelle fix` and prints a hint otherwise.
+func fixFile(c *config.Config, f *rule.File) {
+	conf := getConfig(c)
+	dir := filepath.Join(c.RepoRoot, f.Pkg)
+	for _, m := range migrations {
+		if m(f, dir, conf, false) {
+			if !c.ShouldFix {
+				log.Printf("%s: build file was generated by an older version of okapi. Run 'gazelle fix' to migrate it.", f.Path)
+				return
+			}
+			m(f, dir, conf, true)
+		}
+	}
+}
+
+func rulesByName(f *rule.File) map[string]*rule.Rule {
+	result := make(map[string]*rule.Rule)
+	for _, r := range f.Rules {
+		result[r.Name()] = r
+	}
+	return result
+}
+
+// Replace the references to the rule `from` with `to` in the string and list attributes of all rules of the file.
+func renameRefs(f *rule.File, from string, to string) {
+	for _, r := range f.Rules {
+		for _, attr := range r.AttrKeys() {
+			if value := r.AttrString(attr); value == ":"+from {
+				r.SetAttr(attr, ":"+to)
+			} else if values := r.AttrStrings(attr); len(values) > 0 {
+				renamed := false
+				for i, value := range values {
+					if value == ":"+from {
+						values[i] = ":" + to
+						renamed = true
+					}
+				}
+				if renamed {
+					r.SetAttr(attr, values)
+				}
+			}
+		}
+	}
+}
+
+// Signatures used to be named `<module>_sig`, so the names of signature rules referenced by a module's `sig` attribute
+// are changed to the current pattern, as well as all references to them.
+// Only rules annotated by Okapi are renamed, and virtual signatures are named after their module and therefore left
+// alone.
+func fixSignatureNames(f *rule.File, dir string, conf *Config, apply bool) bool {
+	byName := rulesByName(f)
+	changed := false
+	for _, r := range f.Rules {
+		if !isModule(r) || isSignature(r) || !isGenerated(r) || r.ShouldKeep() {
+			continue
+		}
+		sig := r.AttrString("sig")
+		if sig == "" {
+			continue
+		}
+		sigRule, exists := byName[removeColon(sig)]
+		want := conf.naming.signatureTarget(r.Name())
+		if !exists || !isSignature(sigRule) || !isGenerated(sigRule) || hasTag("virt", sigRule) || sigRule.Name() == want {
+			continue
+		}
+		if _, taken := byName[want]; taken {
+			continue
+		}
+		changed = true
+		if apply {
+			renameRefs(f, sigRule.Name(), want)
+			sigRule.SetName(want)
+			byName[want] = sigRule
+		}
+	}
+	return changed
+}
+
+var moduleListAttrs = []string{"submodules", "modules", "manifest"}
+
+// Modules in libraries used to be listed by name instead of label.
+func fixModuleLabels(f *rule.File, dir string, conf *Config, apply bool) bool {
+	changed := false
+	for _, r := range f.Rules {
+		if !isLibrary(r) || r.ShouldKeep() {
+			continue
+		}
+		for _, attr := range moduleListAttrs {
+			mods := r.AttrStrings(attr)
+			var fixed []string
+			for _, mod := range mods {
+				if !isLabel(mod) {
+					changed = true
+					mod = ":" + mod
+				}
+				fixed = append(fixed, mod)
+			}
+			if apply && len(fixed) > 0 {
+				r.SetAttr(attr, fixed)
+			}
+		}
+	}
+	return changed
+}
+
+func hasDune(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "dune"))
+	return err == nil
+}
+
+// Libraries used to be generated without `# okapi:public_name`, and libraries generated without a Dune config without
+// `# okapi:auto`.
+// The public name defaults to the library name, and a build file with a single library and no Dune config was created
+// in auto mode, so its library owns new modules.
+func fixAnnotations(f *rule.File, dir string, conf *Config, apply bool) bool {
+	var libs []*rule.Rule
+	auto := false
+	for _, r := range f.Rules {
+		if isLibrary(r) && !isNamespace(r) {
+			libs = append(libs, r)
+			auto = auto || hasTag("auto", r)
+		}
+	}
+	changed := false
+	for _, r := range libs {
+		if _, exists := ruleConfig(r, "public_name"); exists {
+			continue
+		}
+		if name, matched := conf.naming.libraryName(r.Name()); matched {
+			changed = true
+			if apply {
+				r.AddComment("# okapi:public_name " + name)
+			}
+		}
+	}
+	if len(libs) == 1 && !auto && !hasDune(dir) {
+		changed = true
+		if apply {
+			libs[0].AddComment("# okapi:auto")
+		}
+	}
+	return changed
+}
+
+var emptyListAttrs = []string{"deps", "deps_opam", "opts"}
+
+func isEmptyList(r *rule.Rule, attr string) bool {
+	list, isList := r.Attr(attr).(*bzl.ListExpr)
+	return isList && len(list.List) == 0
+}
+
+// Empty dependency and option lists used to be emitted for every module, and some attributes aren't supported by the
+// current backend.
+func fixObsoleteAttrs(f *rule.File, dir string, conf *Config, apply bool) bool {
+	changed := false
+	for _, r := range f.Rules {
+		if !(isSource(r) || isExecutable(r)) || r.ShouldKeep() {
+			continue
+		}
+		for _, attr := range emptyListAttrs {
+			if isEmptyList(r, attr) {
+				changed = true
+				if apply {
+					r.DelAttr(attr)
+				}
+			}
+		}
+		for _, attr := range conf.backend.obsoleteAttrs() {
+			if r.Attr(attr) != nil {
+				changed = true
+				if apply {
+					r.DelAttr(attr)
+				}
+			}
+		}
+	}
+	return changed
+}
+
+// Names of the rules in the same package that are referenced by the attributes `attrs` of `r`.
+func localRefs(r *rule.Rule, attrs []string) []string {
+	var result []string
+	for _, attr := range attrs {
+		values := r.AttrStrings(attr)
+		if value := r.AttrString(attr); value != "" {
+			values = append(values, value)
+		}
+		for _, value := range values {
+			if !strings.HasPrefix(value, "//") && !strings.HasPrefix(value, "@") {
+				result = append(result, removeColon(value))
+			}
+		}
+	}
+	return result
+}
+
+var ownerAttrs = append(append([]string{}, moduleListAttrs...), "deps", "main")
+
+// Module, signature, lexer and ppx rules used to be generated without `# okapi:generated`, which `staleRules` requires.
+// The rules that belong to an Okapi library or executable are annotated, as well as the signatures, lexers and ppx
+// executables those modules use.
+func fixGeneratedTags(f *rule.File, dir string, conf *Config, apply bool) bool {
+	byName := rulesByName(f)
+	var owned []string
+	for _, r := range f.Rules {
+		if _, isComponent := ruleConfig(r, "public_name"); isComponent && (isLibrary(r) || isExecutable(r)) {
+			owned = append(owned, localRefs(r, ownerAttrs)...)
+		}
+	}
+	changed := false
+	seen := make(map[string]bool)
+	for i := 0; i < len(owned); i++ {
+		r, exists := byName[owned[i]]
+		if !exists || seen[r.Name()] {
+			continue
+		}
+		seen[r.Name()] = true
+		isLexer := r.Kind() == "ocaml_lex"
+		if !(isModule(r) || isLexer || isPpxDriver(r, conf.naming)) || isGenerated(r) || r.ShouldKeep() {
+			continue
+		}
+		if isModule(r) {
+			owned = append(owned, localRefs(r, []string{"sig", "struct", "ppx"})...)
+		}
+		changed = true
+		if apply {
+			tagGenerated(r)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,112 @@
+package okapi
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// The output of an earlier version of Okapi for the example project
+const oldBuild = `
+ocaml_module(
+    name = "a2",
+    sig = ":a2_sig",
+    struct = ":a2.ml",
+    deps = [":f1"],
+)
+
+ocaml_signature(
+    name = "a2_sig",
+    src = ":a2.mli",
+    deps = [":f1"],
+)
+
+ppx_module(
+    name = "f1",
+    deps_opam = [],
+    opts = [],
+    ppx = ":ppx_a",
+    ppx_print = "@ppx//print:text",
+    struct = ":f1.ml",
+)
+
+ocaml_module(
+    name = "extra",
+    sig = ":extra_sig",
+    struct = ":extra.ml",
+)
+
+ocaml_signature(
+    name = "extra_sig",
+    src = ":extra.mli",
+)
+
+filegroup(
+    name = "interfaces",
+    srcs = [
+        ":a2_sig",
+        ":extra_sig",
+    ],
+)
+
+ocaml_ns_library(
+    name = "#A",
+    submodules = [
+        ":a2",
+        "f1",
+    ],
+    visibility = ["//visibility:public"],
+)
+`
+
+func fixData(t *testing.T, c *config.Config) *rule.File {
+	f, err := rule.LoadData("a/BUILD.bazel", "a", []byte(oldBuild))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RepoRoot = t.TempDir()
+	fixFile(c, f)
+	return f
+}
+
+func TestFix(t *testing.T) {
+	c := config.New()
+	configure(c, "", nil)
+	if rulesByName(fixData(t, c))["a2_sig"] == nil {
+		t.Fatalf("build file was modified outside of `gazelle fix`")
+	}
+	c.ShouldFix = true
+	f := fixData(t, c)
+	byName := rulesByName(f)
+	checkOutput(t, byName["a2"].AttrString("sig"), ":a2__sig")
+	checkOutput(t, byName["a2__sig"].AttrString("src"), ":a2.mli")
+	checkOutput(t, byName["interfaces"].AttrStrings("srcs"), []string{":a2__sig", ":extra_sig"})
+	checkOutput(t, byName["extra"].AttrString("sig"), ":extra_sig")
+	lib := byName["#A"]
+	checkOutput(t, lib.AttrStrings("submodules"), []string{":a2", ":f1"})
+	checkOutput(t, ruleConfigOr(lib, "public_name", ""), "a")
+	if !hasTag("auto", lib) {
+		t.Fatalf("library wasn't annotated with `# okapi:auto`")
+	}
+	f1 := byName["f1"]
+	for _, attr := range []string{"deps_opam", "opts"} {
+		if f1.Attr(attr) != nil {
+			t.Fatalf("empty attribute `%s` wasn't removed", attr)
+		}
+	}
+	checkOutput(t, f1.AttrString("ppx_print"), "@ppx//print:text")
+	for _, name := range []string{"a2", "a2__sig", "f1"} {
+		if !isGenerated(byName[name]) {
+			t.Fatalf("%s wasn't annotated with `# okapi:generated`", name)
+		}
+	}
+	if isGenerated(byName["extra"]) {
+		t.Fatalf("a module that isn't part of a library was annotated with `# okapi:generated`")
+	}
+	c.Exts[okapiName].(*Config).backend = RulesOcamlBackend{}
+	f = fixData(t, c)
+	if rulesByName(f)["f1"].Attr("ppx_print") != nil {
+		t.Fatalf("`ppx_print` wasn't removed for the rules_ocaml backend")
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"log"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
-func GenerateRulesAuto(name string, sources Deps, library bool) []RuleResult {
+func GenerateRulesAuto(name string, sources Deps, conf *Config) []RuleResult {
 	var keys []string
 	for key := range sources {
 		keys = append(keys, key)
@@ -39,22 +41,35 @@ func GenerateRulesAuto(name string, sources Deps, library bool) []RuleResult {
 		},
 		sources: &srcSet,
 	}
-	return append(sourceRules(srcSet), component(lib, library)...)
+	return append(sourceRules(srcSet, conf), component(lib, conf)...)
 }
 
-func GenerateRulesDune(name string, sources Deps, duneCode string, library bool) []RuleResult {
-	conf := parseDuneFile(duneCode)
-	duneConf := decodeDuneConfig(name, conf)
+func GenerateRulesDune(name string, sources Deps, duneCode string, conf *Config) []RuleResult {
+	dune := parseDuneFile(duneCode)
+	duneConf := decodeDuneConfig(name, dune, conf.project)
 	spec := duneToSpec(duneConf)
-	return multilib(spec, sources, library)
+	spec.rules = duneRules(dune, duneCode, conf)
+	return multilib(spec, sources, conf)
 }
 
-func GenerateRules(dir string, sources Deps, dune string, library bool) []RuleResult {
+// The genrules of the Dune file at `path`, translated from its `rule` stanzas and copying the files of its
+// `copy_files` stanzas.
+func duneRules(dune SexpList, path string, conf *Config) []DuneRule {
+	rules := decodeDuneRules(dune)
+	pkg, _ := filePackage(conf.repoRoot, path)
+	files := copiedFiles(filepath.Dir(path), decodeCopyFiles(dune))
+	if cp, exists := copyRule(conf.repoRoot, pkg, files, conf.naming); exists {
+		rules = append(rules, cp)
+	}
+	return rules
+}
+
+func GenerateRules(dir string, sources Deps, dune string, conf *Config) []RuleResult {
 	name := filepath.Base(dir)
 	if dune == "" {
-		return GenerateRulesAuto(name, sources, library)
+		return GenerateRulesAuto(name, sources, conf)
 	} else {
-		return GenerateRulesDune(name, sources, dune, library)
+		return GenerateRulesDune(name, sources, dune, conf)
 	}
 }
 
@@ -74,6 +89,12 @@ func hasTag(name string, r *rule.Rule) bool {
 	return contains(name, tags(r))
 }
 
+// Module, signature, lexer and ppx rules that Okapi creates are annotated with `# okapi:generated`, so that
+// hand-written rules in the same build file are never deleted, see `staleRules`.
+func tagGenerated(r *rule.Rule) { r.AddComment("# okapi:generated") }
+
+func isGenerated(r *rule.Rule) bool { return hasTag("generated", r) }
+
 func ruleConfigs(r *rule.Rule) []KeyValue {
 	var kvs []KeyValue
 	rex := regexp.MustCompile(`^# okapi:(\S+) (\S.*)`)
@@ -114,9 +135,6 @@ func ruleConfigOr(r *rule.Rule, key string, def string) string {
 	}
 }
 
-// TODO need to fill in the deps somewhere after parsing, by looking for the corresponding ppx_executable
-// maybe that can even be skipped by passing around a flag `UpdateMode` and not emitting a ppx_executable when true,
-// since it would just generate the identical rule again.
 var libKinds = map[string]LibraryKind{
 	"ocaml_ns_library": LibNs{},
 	"ppx_ns_library":   LibNsPpx{},
@@ -126,6 +144,7 @@ var libKinds = map[string]LibraryKind{
 	"ppx_ns_archive":   LibNsPpx{},
 	"ocaml_archive":    LibPlain{},
 	"ppx_archive":      LibPpx{},
+	"ocaml_ns":         LibNs{},
 }
 
 func isLibrary(r *rule.Rule) bool {
@@ -133,6 +152,12 @@ func isLibrary(r *rule.Rule) bool {
 	return isLib
 }
 
+// A nested namespace generated for a subdirectory with `(include_subdirs qualified)`, which is part of another library.
+func isNamespace(r *rule.Rule) bool {
+	_, exists := ruleConfig(r, "namespace")
+	return isLibrary(r) && exists
+}
+
 var sourceKinds = map[string]bool{
 	"ocaml_signature": true,
 	"ocaml_module":    true,
@@ -171,13 +196,13 @@ func isExecutable(r *rule.Rule) bool {
 	return isExecutable
 }
 
-func slug(name string) string {
-	rex := regexp.MustCompile("#([[:upper:]])(.*)")
-	match := rex.FindStringSubmatch(name)
-	if len(match) != 2 {
-		log.Fatal("Library name " + name + " couldn't be parsed.'")
+// Reverse the library target names created by `Library.componentRule`.
+func slug(name string, naming Naming) string {
+	lib, matched := naming.libraryName(name)
+	if !matched {
+		log.Fatal("Library name " + name + " couldn't be parsed.")
 	}
-	return strings.ToLower(match[0]) + match[1]
+	return lib
 }
 
 func removeColon(name string) string {
@@ -188,59 +213,424 @@ func removeColon(name string) string {
 	}
 }
 
-// TODO See https://github.com/tweag/okapi/issues/9
-// This uses only the `deps` names that correspond to existing source files.
-// It should also consider generated sources, like from selects and manual rules.
-// Probably needs to scan existing module rules as well.
-// TODO general question about attrs like opts and deps_opam: is it more sensible to leave these nil when updating,
-// since they get merged anyway?
-// TODO `deps` is wrong, this needs to use `submodules` or `modules` (`kind.moduleAttr`)
-// TODO this needs to return the modules to be added to `PackageSpec` now
-// func existingLibrary(r *rule.Rule, i int, sources Deps) (ComponentSpec, bool) {
-//   if kind, isLib := libKinds[r.Name()]; isLib {
-//     var moduleSpec ModuleSpec = AutoModules{}
-//     if len(r.AttrStrings("deps")) > 0 {
-//       var modules []string
-//       for _, name := range r.AttrStrings("deps") {
-//         clean := removeColon(name)
-//         modules = append(modules, clean)
-//         // if src, exists := sources[clean]; exists { modules = append(modules, src) }
-//       }
-//       moduleSpec = ConcreteModules{modules}
-//     }
-//     nameSlug := slug(r.Name())
-//     publicName := ruleConfigOr(r, "public_name", nameSlug)
-//     implements := ruleConfigOr(r, "implements", "")
-//     var ppx PpxKind = NoPpx{}
-//     if kind.ppx() { ppx = PpxTransitive{} }
-//     lib := ComponentSpec{
-//       name: ComponentName{
-//         name: nameSlug,
-//         public: publicName,
-//       },
-//       modules: i,
-//       depsOpam: nil,
-//       ppx: ppx,
-//       kind: LibSpec{
-//         wrapped: kind.wrapped(),
-//         virtualModules: nil,
-//         implements: implements,
-//       },
-//     }
-//     return lib, true
-//   }
-//   return ComponentSpec{}, false
-// }
-
-// func existingLibraries(rules []*rule.Rule, sources Deps) PackageSpec {
-//   var libs []ComponentSpec
-//   for i, r := range rules {
-//     if lib, isLib := existingLibrary(r, i, sources); isLib { libs = append(libs, lib) }
-//   }
-//   return PackageSpec{libs, nil, nil}
-// }
-
-// func AmendRules(args language.GenerateArgs, rules []*rule.Rule, sources Deps, library bool) []RuleResult {
-//   spec := existingLibraries(rules, sources)
-//   return multilib(spec, sources, library)
-// }
+func appendUnique(items []string, new ...string) []string {
+	for _, item := range new {
+		if !contains(item, items) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// The modules of nested namespaces are attributed to the library containing them.
+func existingModuleNames(r *rule.Rule, rules map[string]*rule.Rule) []string {
+	var result []string
+	for _, attr := range moduleListAttrs {
+		for _, name := range r.AttrStrings(attr) {
+			name = removeColon(name)
+			if ns, exists := rules[name]; exists && isNamespace(ns) {
+				result = append(result, existingModuleNames(ns, rules)...)
+			} else {
+				result = append(result, name)
+			}
+		}
+	}
+	return result
+}
+
+// The settings of a library or executable that are stored in the rules of its modules.
+type ExistingModules struct {
+	names    []string
+	virtual  []string
+	choices  []Source
+	depsOpam []string
+	flags    []string
+	// Flags for either bytecode or native compilation, which are selected on the mode
+	modeFlags ModeFlags
+	// The `opts` of the first module, if they select the flags of the profiles
+	profileOpts bzl.Expr
+	ppx         PpxKind
+	// The `target_compatible_with` of the first module that has one
+	enabledIf Compatibility
+}
+
+func existingPpx(r *rule.Rule, rules map[string]*rule.Rule) PpxKind {
+	target := r.AttrString("ppx")
+	var deps []string
+	if exe, exists := rules[removeColon(target)]; exists {
+		deps = exe.AttrStrings("deps_opam")
+		for _, dep := range exe.AttrStrings("deps") {
+			if name, isOpam := opamName(dep); isOpam {
+				deps = append(deps, name)
+			}
+		}
+	}
+	return PpxExisting{target, deps, r.AttrStrings("ppx_args"), r.AttrStrings("ppx_data")}
+}
+
+// The preprocessing of an existing module, which is either done by a ppx executable or by a command passed with `-pp`.
+func existingModulePpx(r *rule.Rule, rules map[string]*rule.Rule) (PpxKind, bool) {
+	if r.Attr("ppx") != nil {
+		return existingPpx(r, rules), true
+	}
+	flags, _ := existingOpts(r)
+	if _, cmd := splitPpOption(flags); cmd != "" {
+		return PpxAction{cmd, ruleConfigOr(r, "path_tools", "")}, true
+	}
+	return nil, false
+}
+
+// Dependencies, options and the preprocessor are stored per module, so this uses the union of the modules'
+// dependencies and the options of the first module that isn't generated.
+// If the modules are preprocessed differently, this uses `PpxPerModule`.
+// Modules whose sources have been deleted are dropped.
+func existingModules(names []string, rules map[string]*rule.Rule, sources Deps) ExistingModules {
+	result := ExistingModules{}
+	flagsFound := false
+	var modules []string
+	ppxs := make(map[string]PpxKind)
+	for _, name := range names {
+		r := rules[name]
+		_, hasSource := sources[name]
+		choices, isChoice := "", false
+		if r != nil {
+			choices, isChoice = ruleConfig(r, "choices")
+		}
+		if r != nil && isSignature(r) && hasTag("virt", r) {
+			if hasSource {
+				result.virtual = append(result.virtual, name)
+			}
+		} else if isChoice {
+			var alts []ModuleAlt
+			for _, choice := range strings.Fields(choices) {
+				alts = append(alts, ModuleAlt{"", choice})
+			}
+			result.choices = append(result.choices, Source{
+				name:      name,
+				intf:      false,
+				virtual:   false,
+				deps:      nil,
+				generator: Choice{alts},
+			})
+		} else if hasSource {
+			result.names = append(result.names, name)
+		} else if _, hasSource := sources[untitleCase(name)]; hasSource {
+			result.names = append(result.names, name)
+		} else {
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		result.depsOpam = appendUnique(result.depsOpam, r.AttrStrings("deps_opam")...)
+		for _, dep := range r.AttrStrings("deps") {
+			if !strings.HasPrefix(dep, ":") {
+				result.depsOpam = appendUnique(result.depsOpam, dep)
+			}
+		}
+		if !flagsFound && strings.HasSuffix(r.AttrString("struct"), ".ml") && isProfileOpts(r.Attr("opts")) {
+			result.profileOpts = r.Attr("opts")
+			flagsFound = true
+		} else if !flagsFound && strings.HasSuffix(r.AttrString("struct"), ".ml") {
+			flags, modeFlags := existingOpts(r)
+			result.flags, _ = splitPpOption(flags)
+			result.modeFlags = modeFlags
+			flagsFound = true
+		}
+		modules = append(modules, name)
+		if expr := r.Attr("target_compatible_with"); expr != nil && result.enabledIf == nil {
+			result.enabledIf = ExistingCompatibility{expr}
+		}
+		if ppx, isPreprocessed := existingModulePpx(r, rules); isPreprocessed {
+			ppxs[name] = ppx
+		}
+	}
+	result.ppx = existingPerModule(ppxs, modules)
+	for _, dep := range result.ppx.depsOpam() {
+		result.depsOpam = remove(dep, result.depsOpam)
+	}
+	return result
+}
+
+func existingLibrary(
+	r *rule.Rule,
+	index int,
+	rules map[string]*rule.Rule,
+	sources Deps,
+	naming Naming,
+) (ComponentSpec, SourcesSpec) {
+	kind := libKinds[r.Kind()]
+	name := slug(r.Name(), naming)
+	componentName := ComponentName{name, ruleConfigOr(r, "public_name", name)}
+	private := strings.Fields(ruleConfigOr(r, "private_modules", ""))
+	mods := existingModules(appendUnique(existingModuleNames(r, rules), private...), rules, sources)
+	var spec ModuleSpec = ConcreteModules{mods.names}
+	var privateModules []string
+	for _, name := range private {
+		if contains(name, mods.names) {
+			privateModules = append(privateModules, name)
+		}
+	}
+	if hasTag("auto", r) {
+		spec = AutoModules{}
+	}
+	return ComponentSpec{componentName, index}, SourcesSpec{
+		modules:  spec,
+		choices:  mods.choices,
+		ppx:      mods.ppx,
+		depsOpam: mods.depsOpam,
+		kind: LibSpec{
+			name:           componentName,
+			wrapped:        kind.wrapped(),
+			virtualModules: mods.virtual,
+			implements:     ruleConfigOr(r, "implements", ""),
+			privateModules: privateModules,
+			reExports:      strings.Fields(ruleConfigOr(r, "re_export", "")),
+			defaultImpl:    ruleConfigOr(r, "default_implementation", ""),
+			stubs:          existingStubs(componentName, rules, naming),
+		},
+		flags:       mods.flags,
+		modeFlags:   mods.modeFlags,
+		profileOpts: mods.profileOpts,
+		enabledIf:   mods.enabledIf,
+		mains:       nil,
+	}
+}
+
+func isExistingExecutable(r *rule.Rule, naming Naming) bool {
+	_, matched := naming.executableName(r.Name())
+	_, isInlineTests := ruleConfig(r, "inline_tests")
+	_, isMode := ruleConfig(r, "mode_of")
+	return isExecutable(r) && matched && !isInlineTests && !isMode && r.AttrString("main") != ""
+}
+
+// Executables created from the same Dune `executables` stanza share their modules, so they are grouped by their module
+// dependencies to avoid generating the module rules twice.
+func existingExecutables(rules []*rule.Rule, naming Naming) [][]*rule.Rule {
+	var keys []string
+	groups := make(map[string][]*rule.Rule)
+	for _, r := range rules {
+		if isExistingExecutable(r, naming) {
+			var locals []string
+			for _, dep := range r.AttrStrings("deps") {
+				if strings.HasPrefix(dep, ":") {
+					locals = append(locals, dep)
+				}
+			}
+			sort.Strings(locals)
+			key := r.Kind() + " " + strings.Join(locals, " ")
+			if _, exists := groups[key]; !exists {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], r)
+		}
+	}
+	var result [][]*rule.Rule
+	for _, key := range keys {
+		result = append(result, groups[key])
+	}
+	return result
+}
+
+// The non-local `deps` of an executable are implementations of virtual libraries, which are passed on as imports so
+// that they are resolved again.
+func existingExecutableGroup(
+	group []*rule.Rule,
+	index int,
+	rules map[string]*rule.Rule,
+	sources Deps,
+	naming Naming,
+) ([]ComponentSpec, SourcesSpec) {
+	var components []ComponentSpec
+	var mains []string
+	var names []string
+	var impls []string
+	for _, r := range group {
+		main := r.AttrString("main")
+		public, _ := naming.executableName(r.Name())
+		components = append(components, ComponentSpec{
+			name:    ComponentName{main, public},
+			modules: index,
+		})
+		mains = append(mains, main)
+		names = appendUnique(names, main)
+		for _, dep := range r.AttrStrings("deps") {
+			if strings.HasPrefix(dep, ":") {
+				names = appendUnique(names, removeColon(dep))
+			} else {
+				impls = appendUnique(impls, dep)
+			}
+		}
+	}
+	mods := existingModules(names, rules, sources)
+	emptyIntf := false
+	for _, main := range mains {
+		if gen, exists := rules[emptyIntfTarget(main, naming)]; exists && hasTag("empty_intf", gen) {
+			emptyIntf = true
+		}
+	}
+	modes := existingModes(group[0])
+	mode := defaultMode
+	if len(modes) > 0 {
+		mode = modes[0]
+	}
+	return components, SourcesSpec{
+		modules:  ConcreteModules{mods.names},
+		choices:  mods.choices,
+		ppx:      mods.ppx,
+		depsOpam: appendUnique(mods.depsOpam, impls...),
+		kind: ExeSpec{
+			test:      strings.HasSuffix(group[0].Kind(), "_test"),
+			modes:     modes,
+			linkFlags: existingLinkFlags(group[0], mode),
+			emptyIntf: emptyIntf,
+		},
+		flags:       mods.flags,
+		modeFlags:   mods.modeFlags,
+		profileOpts: mods.profileOpts,
+		enabledIf:   mods.enabledIf,
+		mains:       mains,
+	}
+}
+
+// Lexer modules aren't listed in libraries, so they are assigned like in a Dune config, as are new ocamlyacc parsers.
+// If there is no auto library, they are added to the first module set.
+func existingGenerated(modules map[int]SourcesSpec, sources Deps) []string {
+	var lexers []string
+	for name, src := range sources {
+		_, isLexer := src.generator.(Lexer)
+		_, isOcamlyacc := src.generator.(Ocamlyacc)
+		if isLexer || isOcamlyacc {
+			lexers = append(lexers, name)
+		}
+	}
+	sort.Strings(lexers)
+	for _, spec := range modules {
+		if spec.modules.auto() {
+			return lexers
+		}
+	}
+	if first, exists := modules[0]; exists && len(lexers) > 0 {
+		first.modules = ConcreteModules{appendUnique(first.modules.names(), lexers...)}
+		modules[0] = first
+	}
+	return lexers
+}
+
+// Reconstruct the spec of a build file that was generated before, using the module lists of the library rules, the
+// attributes of the module rules and the `# okapi:` annotations.
+// Executables are only recognized if they follow the naming scheme used by `Executable.componentRule`.
+func existingSpec(rules []*rule.Rule, sources Deps, naming Naming) PackageSpec {
+	byName := make(map[string]*rule.Rule)
+	for _, r := range rules {
+		byName[r.Name()] = r
+	}
+	var components []ComponentSpec
+	modules := make(map[int]SourcesSpec)
+	index := 0
+	for _, r := range rules {
+		if isLibrary(r) && !isNamespace(r) {
+			component, srcs := existingLibrary(r, index, byName, sources, naming)
+			components = append(components, component)
+			modules[index] = srcs
+			index += 1
+		}
+	}
+	for _, group := range existingExecutables(rules, naming) {
+		comps, srcs := existingExecutableGroup(group, index, byName, sources, naming)
+		components = append(components, comps...)
+		modules[index] = srcs
+		index += 1
+	}
+	return PackageSpec{
+		components: components,
+		modules:    modules,
+		generated:  existingGenerated(modules, sources),
+	}
+}
+
+// Update a build file that already contains libraries, keeping the existing assignment of modules to libraries while
+// adding new sources to the auto library and dropping deleted ones.
+// The `rule` and `copy_files` stanzas of the Dune file at `dune`, if any, are translated again, since they aren't part
+// of the spec, and so are the flags of the components that still have a stanza.
+func AmendRules(rules []*rule.Rule, sources Deps, dune string, conf *Config) []RuleResult {
+	spec := existingSpec(rules, sources, conf.naming)
+	if dune != "" {
+		parsed := parseDuneFile(dune)
+		spec.rules = duneRules(parsed, dune, conf)
+		spec = withDuneFlags(spec, decodeDuneConfig(filepath.Base(filepath.Dir(dune)), parsed, conf.project))
+	}
+	return multilib(spec, sources, conf)
+}
+
+// Replace the flags read from the `opts` of existing modules with the flag fields of the Dune stanzas of the same
+// components, so that the flags of the profiles are evaluated again after the `env` stanzas have changed.
+func withDuneFlags(spec PackageSpec, dune DuneConfig) PackageSpec {
+	fields := make(map[string]*FlagFields)
+	for i, comp := range dune.components {
+		for _, name := range comp.core.names {
+			fields[name.name] = &dune.components[i].core.flags
+		}
+	}
+	for _, comp := range spec.components {
+		if flags, exists := fields[comp.name.name]; exists {
+			srcs := spec.modules[comp.modules]
+			srcs.fields = flags
+			srcs.flags = nil
+			srcs.modeFlags = ModeFlags{}
+			srcs.profileOpts = nil
+			spec.modules[comp.modules] = srcs
+		}
+	}
+	return spec
+}
+
+// Rules that Okapi created to generate sources, like `ocaml_lex` or the genrules for parsers.
+func isGenerator(r *rule.Rule) bool {
+	tagged := hasTag("menhir", r) || hasTag("ocamlyacc", r) || hasTag("empty_intf", r) || hasTag("rule", r)
+	return (r.Kind() == "ocaml_lex" && isGenerated(r)) || (r.Kind() == "genrule" && tagged)
+}
+
+func isPpxDriver(r *rule.Rule, naming Naming) bool {
+	return r.Kind() == "ppx_executable" && naming.isPpxTarget(r.Name())
+}
+
+// Module, signature, generator, stubs, nested namespace and ppx rules from an earlier run that weren't generated again, because
+// their sources or Dune stanzas have been removed.
+// These are returned as empty rules, which causes Gazelle to delete them from the build file.
+// Only rules with an Okapi annotation are considered, so hand-written rules are kept, even when the build file is
+// generated for the first time.
+// ppx executables are kept if a generated module still uses them, since they aren't regenerated when updating, and
+// the runners of inline tests are kept as long as their library exists.
+func staleRules(f *rule.File, gen []*rule.Rule, naming Naming) []*rule.Rule {
+	if f == nil {
+		return nil
+	}
+	generated := make(map[string]bool)
+	ppxs := make(map[string]bool)
+	for _, r := range gen {
+		generated[r.Name()] = true
+		if ppx := r.AttrString("ppx"); ppx != "" {
+			ppxs[removeColon(ppx)] = true
+		}
+	}
+	var result []*rule.Rule
+	for _, r := range f.Rules {
+		if generated[r.Name()] {
+			continue
+		}
+		if lib, isInlineTests := ruleConfig(r, "inline_tests"); isInlineTests {
+			if !generated[lib] {
+				result = append(result, rule.NewRule(r.Kind(), r.Name()))
+			}
+			continue
+		}
+		owned := isGenerated(r) && (isModule(r) || (isPpxDriver(r, naming) && !ppxs[r.Name()]))
+		copies := r.Kind() == "filegroup" && hasTag("copy_files", r)
+		stubs := r.Kind() == "cc_library" && hasTag("stubs", r)
+		if owned || copies || stubs || isNamespace(r) || isGenerator(r) {
+			result = append(result, rule.NewRule(r.Kind(), r.Name()))
+		}
+	}
+	return result
+}
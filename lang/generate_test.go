@@ -0,0 +1,197 @@
+package okapi
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/merger"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+func src(name string, intf bool, deps ...string) Source {
+	return Source{name: name, intf: intf, virtual: false, deps: deps, generator: NoGenerator{}}
+}
+
+// Write the rules to a build file and parse it again, like Gazelle does on the next run.
+// All imports of modules are resolved as OPAM dependencies.
+func buildFile(t *testing.T, results []RuleResult) *rule.File {
+	f := rule.EmptyFile("BUILD.bazel", "")
+	for _, result := range results {
+		if isSource(result.rule) {
+			LegacyBackend{}.opamDeps(result.rule, result.deps)
+		}
+		result.rule.Insert(f)
+	}
+	loaded, err := rule.LoadData("BUILD.bazel", "", f.Format())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+func ruleNames(results []RuleResult) []string {
+	var names []string
+	for _, result := range results {
+		names = append(names, result.rule.Name())
+	}
+	return names
+}
+
+func findResult(t *testing.T, results []RuleResult, name string) RuleResult {
+	for _, result := range results {
+		if result.rule.Name() == name {
+			return result
+		}
+	}
+	t.Fatalf("no rule named %s in %#v", name, ruleNames(results))
+	return RuleResult{}
+}
+
+func TestAmendAuto(t *testing.T) {
+	conf := defaultConfig()
+	sources := Deps{
+		"a2": src("a2", true, "f1"),
+		"a3": src("a3", false, "a2", "f1"),
+		"f1": src("f1", true),
+	}
+	f := buildFile(t, GenerateRulesAuto("a", sources, conf))
+	delete(sources, "a3")
+	sources["a4"] = src("a4", false, "f1")
+	results := AmendRules(f.Rules, sources, "", conf)
+	checkOutput(t, ruleNames(results), []string{"a2__sig", "a2", "a4", "f1__sig", "f1", "#A"})
+	checkOutput(t, findResult(t, results, "#A").rule.AttrStrings("submodules"), []string{":a2", ":a4", ":f1"})
+}
+
+func TestAmendDune(t *testing.T) {
+	conf := defaultConfig()
+	sources := Deps{
+		"bar":     src("bar", false),
+		"foo":     src("foo", false, "bar"),
+		"sub":     src("sub", false),
+		"choice1": src("choice1", false),
+		"choice2": src("choice2", false),
+	}
+	spec := duneToSpec(decodeDuneConfig("sub", parseDune(duneFile), defaultProject))
+	f := buildFile(t, multilib(spec, sources, conf))
+	sources["extra"] = src("extra", false, "sub")
+	results := AmendRules(f.Rules, sources, "", conf)
+	checkOutput(t, findResult(t, results, "#Sub_lib").rule.AttrStrings("submodules"), []string{":extra", ":final", ":sub"})
+	checkOutput(t, findResult(t, results, "#Sub_extra_lib").rule.AttrStrings("submodules"), []string{":bar", ":foo"})
+	extra := findResult(t, results, "extra")
+	checkOutput(t, extra.rule.AttrStrings("opts"), []string{"-open", "Angstrom"})
+	checkOutput(t, extra.deps, []string{"angstrom", "re", "ipaddr"})
+	checkOutput(t, extra.rule.AttrStrings("deps"), []string{":sub"})
+	foo := findResult(t, results, "foo")
+	checkOutput(t, foo.rule.Kind(), "ppx_module")
+	checkOutput(t, foo.rule.AttrString("ppx"), ":ppx_set-1")
+	checkOutput(t, foo.deps, []string{"ppx_inline_test"})
+	for _, name := range ruleNames(results) {
+		if name == "choice1" || name == "choice2" || name == "ppx_set-1" {
+			t.Fatalf("rule %s was generated when updating", name)
+		}
+	}
+}
+
+func TestStaleRules(t *testing.T) {
+	conf := defaultConfig()
+	sources := Deps{
+		"a2": src("a2", true, "f1"),
+		"a3": src("a3", false, "a2", "f1"),
+		"f1": src("f1", true),
+	}
+	handWritten := rule.NewRule("ocaml_module", "hand_written")
+	handWritten.SetAttr("struct", ":hand_written.ml")
+	f := buildFile(t, append(GenerateRulesAuto("a", sources, conf), RuleResult{handWritten, nil}))
+	delete(sources, "a3")
+	sources["f1"] = src("f1", false)
+	var gen []*rule.Rule
+	for _, result := range AmendRules(f.Rules, sources, "", conf) {
+		gen = append(gen, result.rule)
+	}
+	empty := staleRules(f, gen, conf.naming)
+	var names []string
+	for _, r := range empty {
+		names = append(names, r.Name())
+	}
+	checkOutput(t, names, []string{"a3", "f1__sig"})
+	merger.MergeFile(f, empty, gen, merger.PreResolve, kinds)
+	var remaining []string
+	for _, r := range f.Rules {
+		remaining = append(remaining, r.Name())
+	}
+	checkOutput(t, remaining, []string{"a2__sig", "a2", "f1", "#A", "hand_written"})
+}
+
+func TestStaleRulesFirstRun(t *testing.T) {
+	conf := defaultConfig()
+	f := rule.EmptyFile("a/BUILD.bazel", "a")
+	handWritten := rule.NewRule("ocaml_module", "hand_written")
+	handWritten.SetAttr("struct", ":hand_written.ml")
+	handWritten.Insert(f)
+	lexer := rule.NewRule("ocaml_lex", "lexer")
+	lexer.SetAttr("src", ":lexer.mll")
+	lexer.Insert(f)
+	var gen []*rule.Rule
+	for _, result := range GenerateRulesAuto("a", Deps{"f1": src("f1", false)}, conf) {
+		gen = append(gen, result.rule)
+	}
+	if empty := staleRules(f, gen, conf.naming); len(empty) != 0 {
+		t.Fatalf("hand-written rules were considered stale: %v", empty)
+	}
+}
+
+func TestMergeRefresh(t *testing.T) {
+	f, err := rule.LoadData("a/BUILD.bazel", "a", []byte(`
+ocaml_module(
+    name = "a2",
+    struct = "a2.ml",
+    sig = ":a2__sig",
+    opts = ["-w", "-39"],
+    deps = [":f0"],
+    deps_opam = [
+        "stale",
+        "pinned",  # keep
+    ],
+)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := rule.NewRule("ocaml_module", "a2")
+	gen.SetAttr("struct", "a2.ml")
+	gen.SetAttr("deps", []string{":f1"})
+	merger.MergeFile(f, nil, []*rule.Rule{gen}, merger.PreResolve, kinds)
+	r := f.Rules[0]
+	if r.Attr("sig") != nil || len(r.AttrStrings("opts")) != 0 {
+		t.Fatalf("generated attributes weren't refreshed: %s", string(f.Format()))
+	}
+	checkOutput(t, r.AttrStrings("deps"), []string{":f0"})
+	LegacyBackend{}.opamDeps(gen, []string{"fresh"})
+	merger.MergeFile(f, nil, []*rule.Rule{gen}, merger.PostResolve, kinds)
+	checkOutput(t, r.AttrStrings("deps"), []string{":f1"})
+	checkOutput(t, r.AttrStrings("deps_opam"), []string{"pinned", "fresh"})
+}
+
+func TestIncludeSubdirsQualified(t *testing.T) {
+	conf := defaultConfig()
+	conf.includeSubdirs = includeQualified
+	inner := src("inner", false)
+	inner.dir = "sub/deep"
+	foo := src("foo", true, "inner")
+	foo.dir = "sub"
+	sources := Deps{
+		"a":     src("a", false, "foo"),
+		"foo":   foo,
+		"inner": inner,
+	}
+	results := GenerateRulesAuto("lib", sources, conf)
+	checkOutput(t, findResult(t, results, "foo").rule.AttrString("struct"), ":sub/foo.ml")
+	checkOutput(t, findResult(t, results, "foo__sig").rule.AttrString("src"), ":sub/foo.mli")
+	checkOutput(t, findResult(t, results, "#Deep").rule.AttrStrings("submodules"), []string{":inner"})
+	checkOutput(t, findResult(t, results, "#Sub").rule.AttrStrings("submodules"), []string{":#Deep", ":foo"})
+	checkOutput(t, findResult(t, results, "#Lib").rule.AttrStrings("submodules"), []string{":#Sub", ":a"})
+	f := buildFile(t, results)
+	sources["b"] = src("b", false)
+	amended := AmendRules(f.Rules, sources, "", conf)
+	checkOutput(t, findResult(t, amended, "#Lib").rule.AttrStrings("submodules"), []string{":#Sub", ":a", ":b"})
+	checkOutput(t, findResult(t, amended, "#Deep").rule.AttrStrings("submodules"), []string{":inner"})
+}
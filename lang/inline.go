@@ -0,0 +1,112 @@
+package okapi
+
+import (
+	"log"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// The `inline_tests` field of a library.
+type InlineTests struct {
+	// Files needed at runtime, from `deps`
+	deps []string
+	// Patterns of files needed at runtime, from `(glob_files ...)` in `deps`
+	globs []string
+	// Arguments for the test runner, from `flags`
+	flags []string
+}
+
+// Add an entry of `deps` to the tests, which is either a file, `(file name)` or `(glob_files pattern)` in the package.
+// Other dependencies, like aliases or files in other directories, are skipped with a warning.
+func (tests *InlineTests) addDep(lib SexpComponent, node SexpNode) {
+	if file, err := node.String(); err == nil && !duneVariable.MatchString(file) {
+		if _, err := fileLabel(file); err == nil {
+			tests.deps = append(tests.deps, file)
+			return
+		}
+	} else if dep, err := actionStrings(node); err == nil && len(dep) == 2 && !strings.Contains(dep[1], "/") {
+		switch dep[0] {
+		case "file":
+			tests.deps = append(tests.deps, dep[1])
+			return
+		case "glob_files":
+			tests.globs = append(tests.globs, expandBraces(dep[1])...)
+			return
+		}
+	}
+	log.Printf("dune %s: skipping unsupported dependency of inline_tests: %#v", lib.stanza(), node)
+}
+
+func decodeInlineTests(lib SexpComponent) *InlineTests {
+	inline, exists := lib.field("inline_tests")
+	if !exists {
+		return nil
+	}
+	tests := InlineTests{flags: inline.list("flags")}
+	if raw, exists := inline.data.Values["deps"]; exists {
+		if l, isList := raw.(SexpList); isList {
+			for _, dep := range l.Sub {
+				tests.addDep(lib, dep)
+			}
+		} else {
+			tests.addDep(lib, raw)
+		}
+	}
+	return &tests
+}
+
+// The `data` of the test, which globs the patterns of `glob_files`.
+func (tests InlineTests) data() interface{} {
+	files := prefixColon(tests.deps)
+	if len(tests.globs) == 0 {
+		return files
+	}
+	glob := rule.GlobValue{Patterns: tests.globs}
+	if len(files) == 0 {
+		return glob
+	}
+	return &bzl.BinaryExpr{X: rule.ExprFromValue(files), Op: "+", Y: rule.ExprFromValue(glob)}
+}
+
+const (
+	inlineTestsRuntime = "ppx_inline_test.runtime-lib"
+	inlineTestsRunner  = "ppx_inline_test.runner.lib"
+)
+
+// Like Dune, the rewriters of a library with inline tests get the library's name, which the runner uses to select the
+// tests to run.
+// The arguments are only added once, since they are read back from the existing rule when updating.
+func inlineTestArgs(r *rule.Rule, lib Library) {
+	args := r.AttrStrings("ppx_args")
+	if !contains("-inline-test-lib", args) {
+		r.SetAttr("ppx_args", append(args, "-inline-test-lib", lib.name.name))
+	}
+}
+
+// Like Dune, the tests are run by an executable whose main module only calls the runtime of `ppx_inline_test`, and
+// which links the runner library of `ppx_inline_test`.
+// The library is linked with `-linkall`, since none of its modules are referenced by the runner.
+// The rules are annotated with the library's target, so they are kept when the library is updated.
+func inlineTestRules(lib Library, component Component, libTarget string, conf *Config) []RuleResult {
+	runner := "inline_test_runner_" + lib.name.name
+	gen := rule.NewRule("genrule", conf.naming.ruleTarget(runner))
+	gen.SetAttr("outs", []string{runner + ".ml"})
+	gen.SetAttr("cmd", "echo 'let () = Ppx_inline_test_lib.Runtime.exit ()' > $(OUTS)")
+	mod := rule.NewRule(conf.backend.moduleKind(false), runner)
+	mod.SetAttr("struct", ":"+runner+".ml")
+	test := rule.NewRule(conf.backend.executableKind(false, true), conf.naming.inlineTestsTarget(lib.name.name))
+	test.SetAttr("main", runner)
+	test.SetAttr("deps", []string{":" + libTarget})
+	test.SetAttr("opts", []string{"-linkall"})
+	test.SetAttr("args", append([]string{"inline-test-runner", lib.name.name}, lib.inlineTests.flags...))
+	if len(lib.inlineTests.deps) > 0 || len(lib.inlineTests.globs) > 0 {
+		test.SetAttr("data", lib.inlineTests.data())
+	}
+	for _, r := range []*rule.Rule{gen, mod, test} {
+		r.AddComment("# okapi:inline_tests " + libTarget)
+	}
+	testDeps := append(append([]string{}, component.sources.depsOpam...), inlineTestsRunner)
+	return []RuleResult{{gen, nil}, {mod, []string{inlineTestsRuntime}}, {test, testDeps}}
+}
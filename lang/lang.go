@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/label"
@@ -16,31 +18,42 @@ import (
 
 const okapiName = "okapi"
 
-type okapiLang struct{}
-
-type Config struct {
-	library *bool
+type okapiLang struct {
+	backend Backend
+	// The `re_export` annotations of the libraries, by label, which are collected by `Imports`
+	reExports ReExports
+	// The `libraries`, `implements` and `default_implementation` annotations of the libraries, by label, which are
+	// collected by `Imports`
+	libraries Libraries
 }
 
 // Entry point to Gazelle
-func NewLanguage() language.Language { return &okapiLang{} }
+func NewLanguage() language.Language {
+	return &okapiLang{backend: LegacyBackend{}, reExports: make(ReExports), libraries: make(Libraries)}
+}
+
+// Entry point to Gazelle, generating rules for the current `rules_ocaml` API
+func NewRulesOcamlLanguage() language.Language {
+	return &okapiLang{backend: RulesOcamlBackend{}, reExports: make(ReExports), libraries: make(Libraries)}
+}
 
 func (*okapiLang) Name() string { return okapiName }
 
-func (*okapiLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
-	library := fs.Bool("library", false, "build libraries instead of archives")
-	c.Exts[okapiName] = Config{
-		library: library,
-	}
+func (lang *okapiLang) RegisterFlags(fs *flag.FlagSet, cmd string, c *config.Config) {
+	registerFlags(fs, c, lang.backend)
 }
 
 func (*okapiLang) CheckFlags(fs *flag.FlagSet, c *config.Config) error { return nil }
 
-func (*okapiLang) KnownDirectives() []string { return []string{} }
+func (*okapiLang) KnownDirectives() []string { return directives }
 
-func (*okapiLang) Configure(c *config.Config, rel string, f *rule.File) {}
+func (*okapiLang) Configure(c *config.Config, rel string, f *rule.File) { configure(c, rel, f) }
 
 // Related to merge
+// Attributes in `MergeableAttrs` are set during generation and replace the existing values before dependency
+// resolution, those in `ResolveAttrs` are set or extended by `Resolve` and replace the existing values afterwards.
+// Values marked with `# keep` are preserved in both cases.
+// Rules of kinds with `NonEmptyAttrs` are deleted when they are returned as empty, see `staleRules`.
 var defaultKind = rule.KindInfo{
 	MatchAny:        false,
 	MatchAttrs:      []string{},
@@ -50,64 +63,179 @@ var defaultKind = rule.KindInfo{
 	ResolveAttrs:    map[string]bool{},
 }
 
+var moduleKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"struct": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs: map[string]bool{
+		"struct":     true,
+		"sig":        true,
+		"opts":       true,
+		"ppx":        true,
+		"ppx_print":  true,
+		"ppx_tags":   true,
+		"ppx_codeps": true,
+		"ppx_args":   true,
+		"ppx_data":   true,
+	},
+	ResolveAttrs: map[string]bool{"deps": true, "deps_opam": true, "implements": true},
+}
+
+var signatureKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"src": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs: map[string]bool{
+		"src":        true,
+		"opts":       true,
+		"ppx":        true,
+		"ppx_print":  true,
+		"ppx_tags":   true,
+		"ppx_codeps": true,
+		"ppx_args":   true,
+		"ppx_data":   true,
+	},
+	ResolveAttrs: map[string]bool{"deps": true, "deps_opam": true},
+}
+
+var libraryKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"submodules": true, "modules": true, "manifest": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"submodules": true, "modules": true, "manifest": true},
+	ResolveAttrs:    map[string]bool{"cc_deps": true},
+}
+
+// The `deps` of executables contain the modules, which are generated, and the implementations of virtual libraries,
+// which are resolved.
+var executableKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"main": true, "opts": true, "mode": true},
+	ResolveAttrs:    map[string]bool{"deps": true},
+}
+
+// `ppx_executable` is used both for ppx drivers, whose dependencies are generated, and for executables that are
+// preprocessed, in the legacy backend.
+var ppxExecutableKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"main": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"main": true, "deps_opam": true, "opts": true, "mode": true},
+	ResolveAttrs:    map[string]bool{"deps": true},
+}
+
+var lexKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"src": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"src": true},
+	ResolveAttrs:    map[string]bool{},
+}
+
+// Generated for parsers, which are marked with an annotation, so that user-defined genrules aren't deleted.
+var genruleKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"srcs": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"srcs": true, "outs": true, "cmd": true},
+	ResolveAttrs:    map[string]bool{},
+}
+
+// Generated for the foreign stubs of libraries, which are marked with an annotation.
+var ccLibraryKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"srcs": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"srcs": true, "hdrs": true, "copts": true, "linkopts": true},
+	ResolveAttrs:    map[string]bool{},
+}
+
+// Generated to export files to the packages copying them with `copy_files`, which are marked with an annotation.
+var filegroupKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{"srcs": true},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"srcs": true},
+	ResolveAttrs:    map[string]bool{},
+}
+
+// Generated for the profiles of Dune's `env` stanza.
+var configSettingKind = rule.KindInfo{
+	MatchAny:        false,
+	MatchAttrs:      []string{},
+	NonEmptyAttrs:   map[string]bool{},
+	SubstituteAttrs: map[string]bool{},
+	MergeableAttrs:  map[string]bool{"define_values": true, "flag_values": true},
+	ResolveAttrs:    map[string]bool{},
+}
+
 var kinds = map[string]rule.KindInfo{
-	"ppx_module":       defaultKind,
-	"ocaml_module":     defaultKind,
-	"ocaml_signature":  defaultKind,
-	"ppx_ns_library":   defaultKind,
-	"ppx_library":      defaultKind,
-	"ocaml_ns_library": defaultKind,
-	"ocaml_library":    defaultKind,
-	"ppx_ns_archive":   defaultKind,
-	"ppx_archive":      defaultKind,
-	"ocaml_ns_archive": defaultKind,
-	"ocaml_archive":    defaultKind,
-	"filegroup":        defaultKind,
-	"ocaml_executable": defaultKind,
-	"ppx_executable":   defaultKind,
-	"ocaml_test":       defaultKind,
-	"ppx_test":         defaultKind,
-	"ocaml_lex":        defaultKind,
+	"ppx_module":       moduleKind,
+	"ocaml_module":     moduleKind,
+	"ocaml_signature":  signatureKind,
+	"ppx_ns_library":   libraryKind,
+	"ppx_library":      libraryKind,
+	"ocaml_ns_library": libraryKind,
+	"ocaml_library":    libraryKind,
+	"ppx_ns_archive":   libraryKind,
+	"ppx_archive":      libraryKind,
+	"ocaml_ns_archive": libraryKind,
+	"ocaml_archive":    libraryKind,
+	"ocaml_ns":         libraryKind,
+	"filegroup":        filegroupKind,
+	"ocaml_executable": executableKind,
+	"ppx_executable":   ppxExecutableKind,
+	"ocaml_test":       executableKind,
+	"ppx_test":         executableKind,
+	"ocaml_lex":        lexKind,
+	"genrule":          genruleKind,
+	"cc_library":       ccLibraryKind,
+	"config_setting":   configSettingKind,
 }
 
 func (*okapiLang) Kinds() map[string]rule.KindInfo { return kinds }
 
 // Load OBazl stuff (functions)
-func (*okapiLang) Loads() []rule.LoadInfo {
-	return []rule.LoadInfo{
-		{
-			Name: "@obazl_rules_ocaml//ocaml:rules.bzl",
-			Symbols: []string{
-				"ocaml_ns_library",
-				"ocaml_library",
-				"ppx_ns_library",
-				"ppx_library",
-				"ocaml_ns_archive",
-				"ocaml_archive",
-				"ppx_ns_archive",
-				"ppx_archive",
-				"ocaml_module",
-				"ppx_module",
-				"ocaml_signature",
-				"ocaml_executable",
-				"ppx_executable",
-				"ocaml_test",
-				"ppx_test",
-				"ocaml_lex",
-			},
-			After: nil,
-		},
-	}
+// Gazelle queries the loads before reading the config, so the backend is fixed when the language is created.
+func (lang *okapiLang) Loads() []rule.LoadInfo {
+	return []rule.LoadInfo{lang.backend.load()}
 }
 
-func (*okapiLang) Fix(c *config.Config, f *rule.File) {}
+func (*okapiLang) Fix(c *config.Config, f *rule.File) { fixFile(c, f) }
 
 // Build the dictionary of libraries (not Opam dependencies) that will be used for dep resolution afterwards
-func (*okapiLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
+func (lang *okapiLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolve.ImportSpec {
 	var imports []resolve.ImportSpec
-	if isLibrary(r) {
-		imports = append(imports, importSpec(r.Name()))
+	if isLibrary(r) && !isNamespace(r) {
+		lib := label.New(c.RepoName, f.Pkg, r.Name()).String()
+		if names, exists := ruleConfig(r, "re_export"); exists {
+			lang.reExports[lib] = strings.Fields(names)
+		}
+		lang.libraries[lib] = LibraryInfo{
+			deps:        strings.Fields(ruleConfigOr(r, "libraries", "")),
+			implements:  ruleConfigOr(r, "implements", ""),
+			defaultImpl: ruleConfigOr(r, "default_implementation", ""),
+		}
+		names := []string{r.Name()}
+		// The Dune name of the library, which is matched against `libraries` like the public name
+		if name, matched := getConfig(c).naming.libraryName(r.Name()); matched {
+			names = appendUnique(names, name)
+		}
 		if name, exists := ruleConfig(r, "public_name"); exists {
+			names = appendUnique(names, name)
+		}
+		for _, name := range names {
 			imports = append(imports, importSpec(name))
 		}
 		if name, exists := ruleConfig(r, "implements"); exists {
@@ -115,7 +243,11 @@ func (*okapiLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolv
 		}
 		if name, exists := ruleConfig(r, "implementation"); exists {
 			imports = append(imports, importSpec("implementation:"+name))
+			// When updating, executables refer to their implementations by label
+			imports = append(imports, importSpec("implementation:"+label.New(c.RepoName, f.Pkg, r.Name()).String()))
 		}
+	} else if name, exists := ruleConfig(r, "stubs"); exists && r.Kind() == "cc_library" {
+		imports = append(imports, importSpec("stubs:"+name))
 	} else if isSignature(r) {
 		if lib, exists := ruleConfig(r, "virt"); exists {
 			imports = append(imports, importSpec(fmt.Sprintf("virt:%s", lib)))
@@ -127,7 +259,7 @@ func (*okapiLang) Imports(c *config.Config, r *rule.Rule, f *rule.File) []resolv
 
 func (*okapiLang) Embeds(r *rule.Rule, from label.Label) []label.Label { return nil }
 
-func (*okapiLang) Resolve(
+func (lang *okapiLang) Resolve(
 	c *config.Config,
 	ix *resolve.RuleIndex,
 	rc *repo.RemoteCache,
@@ -136,10 +268,13 @@ func (*okapiLang) Resolve(
 	from label.Label,
 ) {
 	if isSource(r) {
-		libraryDeps(c, ix, imports, r)
+		libraryDeps(c, ix, imports, r, lang.reExports)
 	}
 	if isExecutable(r) {
-		executableDeps(c, ix, imports, r)
+		executableDeps(c, ix, imports, r, lang.libraries, lang.reExports)
+	}
+	if isLibrary(r) && !isNamespace(r) {
+		resolveStubs(c, ix, r, from)
 	}
 }
 
@@ -158,8 +293,8 @@ var emptyResult = language.GenerateResult{
 	Imports: []interface{}{},
 }
 
-func containsOcaml(args language.GenerateArgs) bool {
-	for _, file := range args.RegularFiles {
+func containsOcaml(files []string) bool {
+	for _, file := range files {
 		ext := filepath.Ext(file)
 		if ext == ".ml" || ext == ".mli" {
 			return true
@@ -168,31 +303,101 @@ func containsOcaml(args language.GenerateArgs) bool {
 	return false
 }
 
-func generateIfOcaml(args language.GenerateArgs, library bool) []RuleResult {
-	if containsOcaml(args) {
+// With `include_subdirs`, the sources in all subdirectories belong to the directory containing the stanza, so they are
+// added to its files as relative paths.
+// Subdirectories that are ignored by the dune file of their parent are skipped.
+func sourceFiles(args language.GenerateArgs, conf *Config) []string {
+	if conf.includeSubdirs == "" {
+		return args.RegularFiles
+	}
+	files := append([]string{}, args.RegularFiles...)
+	subdirs := map[string]Subdirs{args.Dir: conf.subdirs}
+	err := filepath.Walk(args.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == args.Dir {
+				return nil
+			}
+			if strings.HasPrefix(info.Name(), ".") || info.Name() == "_build" {
+				return filepath.SkipDir
+			}
+			if subdirs[filepath.Dir(path)].excludes(info.Name()) {
+				return filepath.SkipDir
+			}
+			if dune, exists := readDune(path); exists {
+				subdirs[path] = decodeSubdirs(dune)
+			}
+			return nil
+		}
+		if filepath.Dir(path) != args.Dir {
+			rel, _ := filepath.Rel(args.Dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Collecting the sources included by %s: %s", args.Dir, err)
+	}
+	return files
+}
+
+func generateIfOcaml(args language.GenerateArgs, files []string, conf *Config) []RuleResult {
+	if containsOcaml(files) {
+		dune := findDune(args.Dir, args.RegularFiles)
 		return GenerateRules(
 			args.Dir,
-			Dependencies(args.Dir, args.RegularFiles),
-			findDune(args.Dir, args.RegularFiles),
-			library,
+			Dependencies(args.Dir, files, duneGenerators(dune)),
+			dune,
+			conf,
 		)
 	} else {
 		return nil
 	}
 }
 
+// The rules that Okapi generated in a directory that Dune ignores, which are deleted, like the components that don't
+// have a Dune stanza anymore.
+func excludedRules(f *rule.File, naming Naming) []*rule.Rule {
+	result := staleRules(f, nil, naming)
+	if f != nil {
+		for _, r := range f.Rules {
+			if _, generated := ruleConfig(r, "public_name"); generated && (isLibrary(r) || isExecutable(r)) {
+				result = append(result, rule.NewRule(r.Kind(), r.Name()))
+			}
+		}
+	}
+	return result
+}
+
 // Main entry point for Okapi.
-func (*okapiLang) GenerateRules(args language.GenerateArgs) language.GenerateResult {
-	config, valid := args.Config.Exts[okapiName].(Config)
-	if !valid {
-		log.Fatalf("invalid config: %#v", args.Config.Exts[okapiName])
+// Directories whose sources are included by a parent directory's library are skipped, while the rules generated in
+// those that Dune ignores are removed.
+func (lang *okapiLang) GenerateRules(args language.GenerateArgs) language.GenerateResult {
+	config := getConfig(args.Config)
+	if config.included(args.Rel) {
+		return emptyResult
 	}
+	if config.excluded {
+		return language.GenerateResult{
+			Gen:     []*rule.Rule{},
+			Empty:   excludedRules(args.File, config.naming),
+			Imports: []interface{}{},
+		}
+	}
+	files := sourceFiles(args, config)
 	var results []RuleResult
 	if args.File != nil && args.File.Rules != nil && containsLibrary(args.File.Rules) {
-		// results = AmendRules(args, args.File.Rules, Dependencies(args.Dir, args.RegularFiles), *config.library)
+		if containsOcaml(files) {
+			dune := findDune(args.Dir, args.RegularFiles)
+			results = AmendRules(args.File.Rules, Dependencies(args.Dir, files, duneGenerators(dune)), dune, config)
+		}
 	} else {
-		results = generateIfOcaml(args, *config.library)
+		results = generateIfOcaml(args, files, config)
 	}
+	results = append(results, profileSettings(args.Rel, config)...)
+	results = append(results, copySources(args.Rel, config)...)
 	// Poorman's unzip
 	var rules []*rule.Rule
 	var imports []interface{}
@@ -202,7 +407,7 @@ func (*okapiLang) GenerateRules(args language.GenerateArgs) language.GenerateRes
 	}
 	return language.GenerateResult{
 		Gen:     rules,
-		Empty:   nil,
+		Empty:   staleRules(args.File, rules, config.naming),
 		Imports: imports,
 	}
 }
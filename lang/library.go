@@ -3,10 +3,12 @@ package okapi
 import (
 	"fmt"
 	"log"
+	"path"
 	"sort"
 	"strings"
 
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 )
 
 type KeyValue struct {
@@ -24,21 +26,46 @@ type ModuleChoice struct {
 	alts []ModuleAlt
 }
 
-func ppxName(libName string) string { return "ppx_" + libName }
+func ppxAttrs(r *rule.Rule, target string, deps []string, conf *Config) {
+	conf.backend.ppxAttrs(r, target, conf.ppxCodeps(deps))
+	if contains("ppx_inline_test", deps) {
+		r.SetAttr("ppx_tags", []string{"inline-test"})
+	}
+}
 
-func addAttrs(slug string, r *rule.Rule, kind PpxKind) {
+// With `per_module`, the module's preprocessing is looked up by its name.
+func addAttrs(slug string, module string, r *rule.Rule, kind PpxKind, conf *Config) {
+	kind, slug = modulePpx(kind, slug, module)
 	if ppx, isDirect := kind.(PpxDirect); isDirect {
-		r.SetAttr("ppx", ":"+ppxName(slug))
-		r.SetAttr("ppx_print", "@ppx//print:text")
-		if contains("ppx_inline_test", ppx.deps) {
-			r.SetAttr("ppx_tags", []string{"inline-test"})
+		ppxAttrs(r, ":"+conf.naming.ppxTarget(slug), ppx.deps, conf)
+		extendAttr(r, "ppx_args", ppx.args)
+		extendAttr(r, "ppx_data", prefixColon(ppx.data))
+	} else if ppx, isExisting := kind.(PpxExisting); isExisting {
+		ppxAttrs(r, ppx.target, ppx.deps, conf)
+		extendAttr(r, "ppx_args", ppx.args)
+		extendAttr(r, "ppx_data", ppx.data)
+	} else if ppx, isAction := kind.(PpxAction); isAction {
+		cmd, err := ppx.command(conf)
+		if err != nil {
+			log.Printf("dune %s: skipping the preprocessing action of %s: %s: %s", slug, module, err, ppx.cmd)
+			return
+		}
+		extendAttr(r, "opts", ppOption(cmd))
+		if ppx.tools != "" {
+			r.AddComment("# okapi:path_tools " + ppx.tools)
 		}
 	}
 }
 
-func extraRules(kind PpxKind, slug string) []RuleResult {
+func extraRules(kind PpxKind, slug string, conf *Config) []RuleResult {
 	if ppx, isDirect := kind.(PpxDirect); isDirect {
-		return ppx.exe(slug)
+		return ppx.exe(conf.naming.ppxTarget(slug), conf.backend)
+	} else if ppx, isPerModule := kind.(PpxPerModule); isPerModule {
+		var result []RuleResult
+		for i, spec := range ppx.specs {
+			result = append(result, extraRules(spec, perModuleTarget(slug, i), conf)...)
+		}
+		return result
 	}
 	return nil
 }
@@ -52,7 +79,7 @@ func libSuffix(library bool) string {
 }
 
 type LibraryKind interface {
-	ruleKind(library bool) string
+	ruleKind(backend Backend, library bool) string
 	ppx() bool
 	wrapped() bool
 }
@@ -62,10 +89,10 @@ type LibNs struct{}
 type LibPpx struct{}
 type LibPlain struct{}
 
-func (LibNsPpx) ruleKind(library bool) string { return "ppx_ns_" + libSuffix(library) }
-func (LibNs) ruleKind(library bool) string    { return "ocaml_ns_" + libSuffix(library) }
-func (LibPpx) ruleKind(library bool) string   { return "ppx_" + libSuffix(library) }
-func (LibPlain) ruleKind(library bool) string { return "ocaml_" + libSuffix(library) }
+func (LibNsPpx) ruleKind(b Backend, library bool) string { return b.libraryKind(true, true, library) }
+func (LibNs) ruleKind(b Backend, library bool) string    { return b.libraryKind(true, false, library) }
+func (LibPpx) ruleKind(b Backend, library bool) string   { return b.libraryKind(false, true, library) }
+func (LibPlain) ruleKind(b Backend, library bool) string { return b.libraryKind(false, false, library) }
 
 func (LibNsPpx) ppx() bool { return true }
 func (LibNs) ppx() bool    { return false }
@@ -78,33 +105,21 @@ func (LibPpx) wrapped() bool   { return false }
 func (LibPlain) wrapped() bool { return false }
 
 type ExeKind interface {
-	ruleKind(test bool) string
+	ruleKind(backend Backend, test bool) string
 	ppx() bool
 }
 
 type ExePpx struct{}
 type ExePlain struct{}
 
-func (ExePpx) ruleKind(test bool) string {
-	if test {
-		return "ppx_test"
-	} else {
-		return "ppx_executable"
-	}
-}
-func (exe ExePlain) ruleKind(test bool) string {
-	if test {
-		return "ocaml_test"
-	} else {
-		return "ocaml_executable"
-	}
-}
+func (ExePpx) ruleKind(b Backend, test bool) string   { return b.executableKind(true, test) }
+func (ExePlain) ruleKind(b Backend, test bool) string { return b.executableKind(false, test) }
 
 func (ExePpx) ppx() bool   { return true }
 func (ExePlain) ppx() bool { return false }
 
 type ComponentKind interface {
-	componentRule(component Component, library bool) *rule.Rule
+	componentRule(component Component, conf *Config) *rule.Rule
 	extraDeps() []string
 }
 
@@ -112,12 +127,24 @@ type Library struct {
 	name           ComponentName
 	virtualModules []Source
 	implements     string
-	kind           LibraryKind
+	stubs          ForeignStubs
+	inlineTests    *InlineTests
+	// Modules that Dune doesn't expose, which are left out of the namespace and only compiled as deps of the library
+	privateModules []string
+	// Libraries that are added to the dependencies of the library's users, see `libraryDeps`
+	reExports []string
+	// `default_implementation` of a virtual library, see `executableDeps`
+	defaultImpl string
+	kind        LibraryKind
 }
 
 type Executable struct {
-	kind ExeKind
-	test bool
+	kind      ExeKind
+	test      bool
+	modes     []ExeMode
+	linkFlags []string
+	// Whether main modules without an interface get an empty one
+	emptyIntf bool
 }
 
 // TODO store stuff like auto, exclude in annotations
@@ -148,7 +175,15 @@ type SourceSet struct {
 	ppx      PpxKind
 	kind     ComponentKind
 	flags    []string
-	mains    []string
+	// Flags for either bytecode or native compilation
+	modeFlags ModeFlags
+	// The flag fields of Dune stanzas, which are evaluated for each profile, or nil
+	fields *FlagFields
+	// The `opts` of existing modules that select the flags of the profiles, or nil
+	profileOpts bzl.Expr
+	// The value of `target_compatible_with`, or nil
+	compatible interface{}
+	mains      []string
 	// TODO merge with sources before constructing
 }
 
@@ -178,10 +213,6 @@ func moduleAttr(wrapped bool) string {
 	}
 }
 
-func nsName(name string) string {
-	return "#" + strings.Title(strings.ReplaceAll(name, "-", "_"))
-}
-
 func targetNames(deps []string) []string {
 	var result []string
 	for _, dep := range deps {
@@ -231,34 +262,134 @@ func exeModules(set *SourceSet) []string {
 	return prefixColon(result)
 }
 
-func libraryRule(lib Library, component Component, library bool, name string, publicName string) *rule.Rule {
-	r := rule.NewRule(lib.kind.ruleKind(library), name)
-	mods := append(component.sources.sources, lib.virtualModules...)
-	r.SetAttr(moduleAttr(lib.kind.wrapped()), libraryModules(mods))
+// The first segment of `sub` below `dir`, if `sub` is a subdirectory of `dir`.
+func childDir(dir string, sub string) (string, bool) {
+	rest := sub
+	if dir != "" {
+		if !strings.HasPrefix(sub, dir+"/") {
+			return "", false
+		}
+		rest = strings.TrimPrefix(sub, dir+"/")
+	}
+	if rest == "" {
+		return "", false
+	}
+	return path.Join(dir, strings.Split(rest, "/")[0]), true
+}
+
+// With `(include_subdirs qualified)`, the modules in each subdirectory are wrapped in a nested namespace that is named
+// after the directory and listed as a submodule of the parent directory's namespace.
+// Returns the entries of the namespace for `dir` and the rules of the nested namespaces below it.
+func namespaceModules(kind string, srcs []Source, dir string, conf *Config) ([]string, []*rule.Rule) {
+	var entries []string
+	var nested []*rule.Rule
+	var children []string
+	for _, src := range srcs {
+		if !src.generator.libraryModule() {
+			continue
+		}
+		if src.dir == dir {
+			entries = append(entries, ":"+src.name)
+		} else if child, isChild := childDir(dir, src.dir); isChild {
+			children = appendUnique(children, child)
+		}
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		childEntries, childNested := namespaceModules(kind, srcs, child, conf)
+		r := rule.NewRule(kind, conf.naming.libraryTarget(path.Base(child), true))
+		r.SetAttr(conf.backend.modulesAttr(true), childEntries)
+		r.AddComment("# okapi:namespace " + child)
+		nested = append(append(nested, childNested...), r)
+		entries = append(entries, ":"+r.Name())
+	}
+	sort.Strings(entries)
+	return entries, nested
+}
+
+func qualifiedNamespaces(lib Library, conf *Config) bool {
+	return conf.includeSubdirs == includeQualified && lib.kind.wrapped()
+}
+
+// The modules and signatures of a library that are listed in its namespace, without the `private_modules`.
+func exposedModules(lib Library, component Component) []Source {
+	var result []Source
+	for _, src := range append(append([]Source{}, component.sources.sources...), lib.virtualModules...) {
+		if !contains(src.name, lib.privateModules) {
+			result = append(result, src)
+		}
+	}
+	return result
+}
+
+func libraryRule(lib Library, component Component, conf *Config, name string, publicName string) *rule.Rule {
+	kind := lib.kind.ruleKind(conf.backend, conf.library)
+	r := rule.NewRule(kind, name)
+	mods := exposedModules(lib, component)
+	entries := libraryModules(mods)
+	if qualifiedNamespaces(lib, conf) {
+		entries, _ = namespaceModules(kind, mods, "", conf)
+	}
+	r.SetAttr(conf.backend.modulesAttr(lib.kind.wrapped()), entries)
+	if len(lib.privateModules) > 0 {
+		r.SetAttr("deps", prefixColon(lib.privateModules))
+	}
 	if lib.implements != "" {
 		r.AddComment("# okapi:implements " + lib.implements)
 		r.AddComment("# okapi:implementation " + publicName)
 	}
+	if len(lib.privateModules) > 0 {
+		r.AddComment("# okapi:private_modules " + strings.Join(lib.privateModules, " "))
+	}
+	if len(lib.reExports) > 0 {
+		r.AddComment("# okapi:re_export " + strings.Join(lib.reExports, " "))
+	}
+	if lib.defaultImpl != "" {
+		r.AddComment("# okapi:default_implementation " + lib.defaultImpl)
+	}
+	if len(component.sources.depsOpam) > 0 {
+		r.AddComment("# okapi:libraries " + strings.Join(component.sources.depsOpam, " "))
+	}
 	return r
 }
 
-func (lib Library) componentRule(component Component, library bool) *rule.Rule {
+func (lib Library) componentRule(component Component, conf *Config) *rule.Rule {
 	name := component.name
-	libName := "lib-" + name.name
-	if lib.kind.wrapped() {
-		libName = nsName(name.name)
-	}
-	return libraryRule(lib, component, library, libName, name.public)
+	return libraryRule(lib, component, conf, conf.naming.libraryTarget(name.name, lib.kind.wrapped()), name.public)
 }
 
-func (exe Executable) componentRule(component Component, library bool) *rule.Rule {
+func (exe Executable) componentRule(component Component, conf *Config) *rule.Rule {
 	name := component.name
-	r := rule.NewRule(exe.kind.ruleKind(exe.test), "exe-"+name.public)
+	r := rule.NewRule(exe.kind.ruleKind(conf.backend, exe.test), conf.naming.executableTarget(name.public))
 	r.SetAttr("main", name.name)
 	r.SetAttr("deps", exeModules(component.sources))
+	extendAttr(r, "opts", exe.linkFlags)
+	if len(exe.modes) > 0 {
+		modeAttrs(r, exe.modes[0])
+		r.AddComment("# okapi:modes " + encodeModes(exe.modes))
+	}
 	return r
 }
 
+// The first mode is used for the executable's main target, the others get a target each, whose name has the suffix of
+// the mode's file in Dune.
+// They are annotated with the main target, so they aren't mistaken for executables when updating.
+func (exe Executable) modeRules(component Component, main *rule.Rule, conf *Config) []RuleResult {
+	var result []RuleResult
+	for i := 1; i < len(exe.modes); i++ {
+		mode := exe.modes[i]
+		r := rule.NewRule(main.Kind(), main.Name()+modeSuffixes[mode])
+		r.SetAttr("main", component.name.name)
+		r.SetAttr("deps", exeModules(component.sources))
+		extendAttr(r, "opts", exe.linkFlags)
+		modeAttrs(r, mode)
+		r.AddComment("# okapi:mode_of " + main.Name())
+		r.SetAttr("visibility", []string{"//visibility:public"})
+		result = append(result, RuleResult{r, component.sources.depsOpam})
+	}
+	return result
+}
+
 func (lib Library) extraDeps() []string {
 	if lib.implements == "" {
 		return nil
@@ -286,63 +417,117 @@ func appendAttr(r *rule.Rule, attr string, v string) {
 	r.SetAttr(attr, append(r.AttrStrings(attr), v))
 }
 
-func commonAttrs(set SourceSet, r *rule.Rule, deps []string) RuleResult {
-	libDeps := append(append(set.depsOpam, set.ppx.depsOpam()...), set.kind.extraDeps()...)
-	extendAttr(r, "opts", set.flags)
+func commonAttrs(set SourceSet, module string, r *rule.Rule, deps []string, conf *Config) RuleResult {
+	ppx, _ := modulePpx(set.ppx, set.name, module)
+	libDeps := append(append(set.depsOpam, conf.backend.ppxImports(ppx.depsOpam())...), set.kind.extraDeps()...)
+	extendAttr(r, "opts", vendorFlags(set.flags, conf))
 	if len(deps) > 0 {
 		r.SetAttr("deps", targetNames(deps))
 	}
-	addAttrs(set.name, r, set.ppx)
+	addAttrs(set.name, module, r, set.ppx, conf)
+	if lib, isLib := set.kind.(Library); isLib && lib.inlineTests != nil && ppx.isPpx() {
+		inlineTestArgs(r, lib)
+	}
+	setOpts(r, set, conf)
+	tagGenerated(r)
 	return RuleResult{r, libDeps}
 }
 
-func sigTarget(src Source) string { return src.name + "__sig" }
-
-func signatureRule(set SourceSet, src Source, deps []string) RuleResult {
-	r := rule.NewRule("ocaml_signature", sigTarget(src))
-	r.SetAttr("src", ":"+src.name+".mli")
-	return commonAttrs(set, r, deps)
+func signatureRule(set SourceSet, src Source, deps []string, conf *Config) RuleResult {
+	r := rule.NewRule("ocaml_signature", conf.naming.signatureTarget(src.name))
+	r.SetAttr("src", src.file(".mli"))
+	return commonAttrs(set, src.name, r, deps, conf)
 }
 
 func virtualSignatureRule(libName string, src Source) *rule.Rule {
 	r := rule.NewRule("ocaml_signature", src.name)
-	r.SetAttr("src", ":"+src.name+".mli")
+	r.SetAttr("src", src.file(".mli"))
 	r.AddComment(fmt.Sprintf("# okapi:virt %s", libName))
 	return r
 }
 
-func moduleRuleName(set SourceSet) string {
-	if set.ppx.isPpx() {
-		return "ppx_module"
-	} else {
-		return "ocaml_module"
-	}
+func moduleRuleName(set SourceSet, module string, conf *Config) string {
+	ppx, _ := modulePpx(set.ppx, set.name, module)
+	return conf.backend.moduleKind(ppx.isPpx())
 }
 
-func moduleRule(set SourceSet, src Source, struct_ string, deps []string) RuleResult {
-	r := rule.NewRule(moduleRuleName(set), src.name)
+func moduleRule(set SourceSet, src Source, struct_ string, deps []string, conf *Config) RuleResult {
+	r := rule.NewRule(moduleRuleName(set, src.name, conf), src.name)
 	r.SetAttr("struct", struct_)
 	if src.intf {
-		r.SetAttr("sig", ":"+sigTarget(src))
+		r.SetAttr("sig", ":"+conf.naming.signatureTarget(src.name))
 	} else if lib, isLib := set.kind.(Library); isLib && lib.implements != "" {
 		r.AddComment(fmt.Sprintf("# okapi:implements %s", lib.implements))
 	}
-	return commonAttrs(set, r, deps)
+	return commonAttrs(set, src.name, r, deps, conf)
 }
 
-func defaultModuleRule(set SourceSet, src Source, deps []string) RuleResult {
-	return moduleRule(set, src, ":"+src.name+".ml", deps)
+func defaultModuleRule(set SourceSet, src Source, deps []string, conf *Config) RuleResult {
+	return moduleRule(set, src, src.file(".ml"), deps, conf)
 }
 
-func lexRules(set SourceSet, src Source, deps []string) []RuleResult {
-	structName := src.name + "_ml"
+// The alternatives are stored in an annotation, so that they aren't assigned to a library when updating.
+func choiceRule(set SourceSet, src Source, choice Choice, deps []string, conf *Config) RuleResult {
+	result := defaultModuleRule(set, src, deps, conf)
+	var alts []string
+	for _, alt := range choice.alts {
+		alts = append(alts, alt.choice)
+	}
+	result.rule.AddComment("# okapi:choices " + strings.Join(alts, " "))
+	return result
+}
+
+func lexRules(set SourceSet, src Source, deps []string, conf *Config) []RuleResult {
+	structName := conf.naming.lexerTarget(src.name)
 	lexRule := rule.NewRule("ocaml_lex", structName)
-	lexRule.SetAttr("src", ":"+src.name+".mll")
-	modRule := moduleRule(set, src, ":"+structName, deps)
-	modRule.rule.SetAttr("opts", []string{"-w", "-39"})
+	lexRule.SetAttr("src", src.file(".mll"))
+	tagGenerated(lexRule)
+	lexSet := set
+	lexSet.flags = []string{"-w", "-39"}
+	if set.fields != nil {
+		lexSet.fields = &FlagFields{setStandard{}, set.fields.byte, set.fields.native}
+	}
+	modRule := moduleRule(lexSet, src, ":"+structName, deps, conf)
 	return []RuleResult{{lexRule, nil}, modRule}
 }
 
+// The parser and its signature are created by a genrule, so the module and signature rules can refer to the outputs by
+// their file names.
+// `args` is the command line of the generator without the grammar, which has to write the outputs to the `parserPrefix`.
+func parserRules(set SourceSet, src Source, tag string, args []string, deps []string, conf *Config) []RuleResult {
+	base := path.Join(src.dir, src.name)
+	gen := rule.NewRule("genrule", conf.naming.parserTarget(src.name))
+	gen.SetAttr("srcs", []string{src.file(".mly")})
+	gen.SetAttr("outs", []string{base + ".ml", base + ".mli"})
+	cmd := append(args, "$(location "+src.file(".mly")+")")
+	gen.SetAttr("cmd", strings.Join(cmd, " "))
+	gen.AddComment("# okapi:" + tag)
+	return []RuleResult{{gen, nil}, defaultModuleRule(set, src, deps, conf)}
+}
+
+// With `executables_implicit_empty_intf`, Dune gives main modules without an interface an empty one, which is created
+// by a genrule here.
+func emptyIntfRule(src Source, conf *Config) *rule.Rule {
+	r := rule.NewRule("genrule", emptyIntfTarget(src.name, conf.naming))
+	r.SetAttr("outs", []string{path.Join(src.dir, src.name+".mli")})
+	r.SetAttr("cmd", "touch $(OUTS)")
+	r.AddComment("# okapi:empty_intf")
+	return r
+}
+
+func emptyIntfTarget(module string, naming Naming) string { return naming.ruleTarget(module + "_intf") }
+
+func parserPrefix(src Source) string { return "$(RULEDIR)/" + path.Join(src.dir, src.name) }
+
+func menhirRules(set SourceSet, src Source, menhir Menhir, deps []string, conf *Config) []RuleResult {
+	args := append(append([]string{"menhir"}, menhir.flags...), "--base", parserPrefix(src))
+	return parserRules(set, src, "menhir", args, deps, conf)
+}
+
+func ocamlyaccRules(set SourceSet, src Source, deps []string, conf *Config) []RuleResult {
+	return parserRules(set, src, "ocamlyacc", []string{"ocamlyacc", "-b", parserPrefix(src)}, deps, conf)
+}
+
 func remove(name string, deps []string) []string {
 	var result []string
 	for _, dep := range deps {
@@ -353,7 +538,16 @@ func remove(name string, deps []string) []string {
 	return result
 }
 
-func librarySourceRules(set SourceSet, lib Library) []RuleResult {
+func isVirtualModule(name string, lib Library) bool {
+	for _, src := range lib.virtualModules {
+		if src.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func librarySourceRules(set SourceSet, lib Library, conf *Config) []RuleResult {
 	var rules []RuleResult
 	var m SourceSlice = lib.virtualModules
 	m.Sort()
@@ -362,55 +556,118 @@ func librarySourceRules(set SourceSet, lib Library) []RuleResult {
 			log.Fatalf("no generator for %#v", src)
 		}
 		cleanDeps := remove(src.name, src.deps)
-		rules = append(rules, commonAttrs(set, virtualSignatureRule(lib.name.public, src), cleanDeps))
+		rules = append(rules, commonAttrs(set, src.name, virtualSignatureRule(lib.name.public, src), cleanDeps, conf))
 	}
 	return rules
 }
 
+// Modules without an implementation, from `modules_without_implementation`, only consist of a signature, which is
+// named after the module.
+func signatureOnlyRule(set SourceSet, src Source, deps []string, conf *Config) RuleResult {
+	r := rule.NewRule("ocaml_signature", src.name)
+	r.SetAttr("src", src.file(".mli"))
+	return commonAttrs(set, src.name, r, deps, conf)
+}
+
 // If the source was generated, the module rule will be handled by the generator logic.
 // This still uses a potential interface though, since that may be supplied unmanaged.
-func sourceRule(set SourceSet, src Source) []RuleResult {
+// Sources that only have an interface are virtual modules, whose rules are created by `librarySourceRules`, or
+// modules without implementation.
+func sourceRule(set SourceSet, src Source, conf *Config) []RuleResult {
 	var rules []RuleResult
 	cleanDeps := remove(src.name, src.deps)
+	if src.virtual {
+		if lib, isLib := set.kind.(Library); isLib && isVirtualModule(src.name, lib) {
+			return nil
+		}
+		return []RuleResult{signatureOnlyRule(set, src, cleanDeps, conf)}
+	}
+	if exe, isExe := set.kind.(Executable); isExe && exe.emptyIntf && !src.intf && contains(src.name, set.mains) {
+		rules = append(rules, RuleResult{emptyIntfRule(src, conf), nil})
+		src.intf = true
+	}
 	if src.intf {
-		rules = append(rules, signatureRule(set, src, cleanDeps))
+		rules = append(rules, signatureRule(set, src, cleanDeps, conf))
 	}
 	if _, isNoGen := src.generator.(NoGenerator); isNoGen {
-		rules = append(rules, defaultModuleRule(set, src, cleanDeps))
+		rules = append(rules, defaultModuleRule(set, src, cleanDeps, conf))
 	} else if _, isLexer := src.generator.(Lexer); isLexer {
-		rules = append(rules, lexRules(set, src, cleanDeps)...)
-	} else if _, isChoice := src.generator.(Choice); isChoice {
-		rules = append(rules, defaultModuleRule(set, src, cleanDeps))
+		rules = append(rules, lexRules(set, src, cleanDeps, conf)...)
+	} else if choice, isChoice := src.generator.(Choice); isChoice {
+		rules = append(rules, choiceRule(set, src, choice, cleanDeps, conf))
+	} else if menhir, isMenhir := src.generator.(Menhir); isMenhir {
+		rules = append(rules, menhirRules(set, src, menhir, cleanDeps, conf)...)
+	} else if _, isOcamlyacc := src.generator.(Ocamlyacc); isOcamlyacc {
+		rules = append(rules, ocamlyaccRules(set, src, cleanDeps, conf)...)
+	} else if _, isRuleTarget := src.generator.(RuleTarget); isRuleTarget {
+		rules = append(rules, defaultModuleRule(set, src, cleanDeps, conf))
+	} else if _, isCopy := src.generator.(Copy); isCopy {
+		rules = append(rules, defaultModuleRule(set, src, cleanDeps, conf))
 	} else {
 		log.Fatalf("no generator for %#v", src)
 	}
 	return rules
 }
 
-func sourceRules(set SourceSet) []RuleResult {
+func sourceRules(set SourceSet, conf *Config) []RuleResult {
 	var rules []RuleResult
-	rules = append(rules, extraRules(set.ppx, set.name)...)
+	rules = append(rules, extraRules(set.ppx, set.name, conf)...)
 	var m SourceSlice = set.sources
 	m.Sort()
 	for _, src := range m {
-		rules = append(rules, sourceRule(set, src)...)
+		rules = append(rules, sourceRule(set, src, conf)...)
 	}
 	if lib, isLib := set.kind.(Library); isLib {
-		rules = append(rules, librarySourceRules(set, lib)...)
+		rules = append(rules, librarySourceRules(set, lib, conf)...)
 	}
-	return rules
+	return withCompatibility(rules, set.compatible)
 }
 
-func component(component Component, library bool) []RuleResult {
+// The nested namespaces of a library with `(include_subdirs qualified)`.
+// Since they are named after their directories, directories with the same name would produce conflicting targets.
+func nestedNamespaces(component Component, conf *Config) []RuleResult {
+	lib, isLib := component.sources.kind.(Library)
+	if !isLib || !qualifiedNamespaces(lib, conf) {
+		return nil
+	}
+	kind := lib.kind.ruleKind(conf.backend, conf.library)
+	_, nested := namespaceModules(kind, exposedModules(lib, component), "", conf)
 	var result []RuleResult
-	r := component.sources.kind.componentRule(component, library)
+	dirs := make(map[string]string)
+	for _, r := range nested {
+		dir, _ := ruleConfig(r, "namespace")
+		if other, exists := dirs[r.Name()]; exists {
+			log.Fatalf("The subdirectories %s and %s of library %s would both be named %s.", other, dir, lib.name.name, r.Name())
+		}
+		dirs[r.Name()] = dir
+		result = append(result, RuleResult{r, nil})
+	}
+	return result
+}
+
+func component(component Component, conf *Config) []RuleResult {
+	result := nestedNamespaces(component, conf)
+	r := component.sources.kind.componentRule(component, conf)
 	if component.sources.spec.auto() {
 		r.AddComment("# okapi:auto")
 	}
 	r.AddComment("# okapi:public_name " + component.name.public)
 	r.SetAttr("visibility", []string{"//visibility:public"})
+	if lib, isLib := component.sources.kind.(Library); isLib {
+		if !lib.stubs.empty() {
+			// The stubs are added to the `cc_deps` of the library when resolving, see `resolveStubs`
+			for _, stubs := range stubsRules(lib, component.name.public, conf) {
+				result = append(result, RuleResult{stubs, nil})
+			}
+		}
+		if lib.inlineTests != nil {
+			result = append(result, inlineTestRules(lib, component, r.Name(), conf)...)
+		}
+	} else if exe, isExe := component.sources.kind.(Executable); isExe {
+		result = append(result, exe.modeRules(component, r, conf)...)
+	}
 	result = append(result, RuleResult{r, component.sources.depsOpam})
-	return result
+	return withCompatibility(result, component.sources.compatible)
 }
 
 type ComponentSources struct {
@@ -466,7 +723,7 @@ func filterAuto(auto []Source, spec ModuleSpec) []Source {
 		var result []Source
 		for _, src := range auto {
 			found := false
-			for _, ex := range exclude.modules {
+			for _, ex := range exclude.excluded {
 				if ex == src.name {
 					found = true
 				}
@@ -492,20 +749,33 @@ func assignAuto(auto []Source, sets map[int]SourceSet) map[int]SourceSet {
 
 // Create final source sets from dune module specs, assigning generated modules and choices.
 // Then pair components with a pointer to the associated source set.
-func componentsWithSources(pkg PackageSpec, generated map[int][]string, deps Deps) ([]ComponentSources, []SourceSet) {
+func componentsWithSources(
+	pkg PackageSpec,
+	generated map[int][]string,
+	deps Deps,
+	conf *Config,
+) ([]ComponentSources, []SourceSet) {
 	var components []ComponentSources
 	sourceSets := make(map[int]SourceSet)
 	for i, mods := range pkg.modules {
 		srcs := moduleSources(append(mods.modules.names(), generated[i]...), deps, mods.choices)
+		var compatible interface{}
+		if mods.enabledIf != nil {
+			compatible = mods.enabledIf.constraints(conf)
+		}
 		sourceSets[i] = SourceSet{
-			name:     fmt.Sprintf("set-%d", i),
-			sources:  srcs,
-			spec:     mods.modules,
-			depsOpam: mods.depsOpam,
-			ppx:      mods.ppx,
-			kind:     mods.kind.toObazl(mods.ppx, deps),
-			flags:    mods.flags,
-			mains:    mods.mains,
+			name:        fmt.Sprintf("set-%d", i),
+			sources:     srcs,
+			spec:        mods.modules,
+			depsOpam:    mods.depsOpam,
+			ppx:         mods.ppx,
+			kind:        mods.kind.toObazl(mods.ppx, deps),
+			flags:       mods.flags,
+			modeFlags:   mods.modeFlags,
+			fields:      mods.fields,
+			profileOpts: mods.profileOpts,
+			compatible:  compatible,
+			mains:       mods.mains,
 		}
 	}
 	auto := autoModules(sourceSets, deps)
@@ -529,9 +799,9 @@ func specComponent(comp ComponentSources) Component {
 	}
 }
 
-func specComponents(spec PackageSpec, sources Deps) Package {
+func specComponents(spec PackageSpec, sources Deps, conf *Config) Package {
 	generated := assignGenerated(spec)
-	withSources, sets := componentsWithSources(spec, generated, sources)
+	withSources, sets := componentsWithSources(spec, generated, sources, conf)
 	var result []Component
 	for _, comp := range withSources {
 		result = append(result, specComponent(comp))
@@ -544,14 +814,14 @@ func specComponents(spec PackageSpec, sources Deps) Package {
 // TODO when `select` directives are used from dune, they don't create module rules for the choices.
 // When gazelle is then run in update mode, they will be created.
 // Either check for rules that select one of the choices or add exclude rules in comments.
-func multilib(spec PackageSpec, sources Deps, library bool) []RuleResult {
-	pkg := specComponents(spec, sources)
-	var rules []RuleResult
+func multilib(spec PackageSpec, sources Deps, conf *Config) []RuleResult {
+	pkg := specComponents(spec, sources, conf)
+	rules := genrules(spec.rules, conf)
 	for _, srcSet := range sortedSourceSets(pkg.sources) {
-		rules = append(rules, sourceRules(srcSet)...)
+		rules = append(rules, sourceRules(srcSet, conf)...)
 	}
 	for _, comp := range sortedComponents(pkg.components) {
-		rules = append(rules, component(comp, library)...)
+		rules = append(rules, component(comp, conf)...)
 	}
 	return rules
 }
@@ -0,0 +1,250 @@
+package okapi
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
+// A mode of an executable from Dune's `modes` field, consisting of a compilation mode (`byte`, `native` or
+// `byte_complete`) and a binary kind (`exe`, `object` or `shared_object`).
+type ExeMode struct {
+	compilation string
+	binary      string
+}
+
+var defaultMode = ExeMode{"native", "exe"}
+
+// The shorthands Dune allows in `modes`, like `byte` for `(byte exe)`.
+var modeShorthands = map[string]ExeMode{
+	"exe":           {"native", "exe"},
+	"native":        {"native", "exe"},
+	"byte":          {"byte", "exe"},
+	"byte_complete": {"byte_complete", "exe"},
+	"object":        {"native", "object"},
+	"shared_object": {"native", "shared_object"},
+}
+
+// The suffixes Dune uses for the files of each mode, which are appended to the names of the additional targets.
+var modeSuffixes = map[ExeMode]string{
+	{"native", "exe"}:           ".exe",
+	{"byte", "exe"}:             ".bc",
+	{"byte_complete", "exe"}:    ".bc.exe",
+	{"native", "object"}:        ".exe.o",
+	{"byte", "object"}:          ".bc.o",
+	{"native", "shared_object"}: ".so",
+	{"byte", "shared_object"}:   ".bc.so",
+}
+
+// The linker options that produce the binary kinds.
+var binaryOpts = map[string][]string{
+	"object":        {"-output-complete-obj"},
+	"shared_object": {"-output-obj"},
+}
+
+func (mode ExeMode) byte() bool { return mode.compilation != "native" }
+
+// The options for the executable rule, `-output-complete-exe` for `byte_complete`.
+func (mode ExeMode) opts() []string {
+	if mode.compilation == "byte_complete" {
+		return append([]string{"-output-complete-exe"}, binaryOpts[mode.binary]...)
+	}
+	return binaryOpts[mode.binary]
+}
+
+// The format of the `# okapi:modes` annotation, like `byte:exe`.
+func (mode ExeMode) String() string { return mode.compilation + ":" + mode.binary }
+
+func parseExeMode(s string) (ExeMode, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return ExeMode{}, fmt.Errorf("invalid mode %s", s)
+	}
+	mode := ExeMode{parts[0], parts[1]}
+	if _, supported := modeSuffixes[mode]; !supported {
+		return ExeMode{}, fmt.Errorf("unsupported mode %s", s)
+	}
+	return mode, nil
+}
+
+// Parse the `modes` field of executables.
+// `best` is translated to `native`, and modes like `js` or `plugin` are skipped with a warning.
+func decodeDuneModes(exe SexpComponent) []ExeMode {
+	raw, exists := exe.data.Values["modes"]
+	if !exists {
+		return nil
+	}
+	items, err := raw.List()
+	if err != nil {
+		exe.fatalf("invalid modes: %#v", raw)
+	}
+	var result []ExeMode
+	for _, item := range items {
+		var mode ExeMode
+		if name, err := item.String(); err == nil {
+			mode = modeShorthands[name]
+		} else if pair, err := sexpStrings(item); err == nil && len(pair) == 2 {
+			mode = ExeMode{pair[0], pair[1]}
+			if mode.compilation == "best" {
+				mode.compilation = "native"
+			}
+		}
+		if _, supported := modeSuffixes[mode]; !supported {
+			log.Printf("dune executable %s: skipping unsupported mode: %#v", exe.name, item)
+			continue
+		}
+		result = append(result, mode)
+	}
+	return result
+}
+
+func encodeModes(modes []ExeMode) string {
+	var result []string
+	for _, mode := range modes {
+		result = append(result, mode.String())
+	}
+	return strings.Join(result, " ")
+}
+
+// Read the `# okapi:modes` annotation of an existing executable.
+func existingModes(r *rule.Rule) []ExeMode {
+	annotation, exists := ruleConfig(r, "modes")
+	if !exists {
+		return nil
+	}
+	var result []ExeMode
+	for _, s := range strings.Fields(annotation) {
+		mode, err := parseExeMode(s)
+		if err != nil {
+			log.Fatalf("Invalid `modes` annotation for %s: %s", r.Name(), err)
+		}
+		result = append(result, mode)
+	}
+	return result
+}
+
+// Compiler flags that only apply in one compilation mode, from `ocamlc_flags` and `ocamlopt_flags`.
+type ModeFlags struct {
+	byte   []string
+	native []string
+}
+
+func (flags ModeFlags) empty() bool { return len(flags.byte) == 0 && len(flags.native) == 0 }
+
+const defaultCondition = "//conditions:default"
+
+// The value of `opts` for modules with mode specific flags, which appends a `select` on the compilation mode to the
+// common flags.
+type modeOpts struct {
+	flags     []string
+	modeFlags ModeFlags
+	byte      string
+}
+
+func (opts modeOpts) BzlExpr() bzl.Expr {
+	sel := rule.SelectStringListValue{
+		opts.byte:        opts.modeFlags.byte,
+		defaultCondition: opts.modeFlags.native,
+	}.BzlExpr()
+	if len(opts.flags) == 0 {
+		return sel
+	}
+	return &bzl.BinaryExpr{X: rule.ExprFromValue(opts.flags), Op: "+", Y: sel}
+}
+
+func setModeOpts(r *rule.Rule, flags ModeFlags, conf *Config) {
+	if !flags.empty() {
+		r.SetAttr("opts", modeOpts{r.AttrStrings("opts"), flags, conf.backend.modeCondition(true)})
+	}
+}
+
+func exprStrings(expr bzl.Expr) ([]string, bool) {
+	l, isList := expr.(*bzl.ListExpr)
+	if !isList {
+		return nil, false
+	}
+	var result []string
+	for _, el := range l.List {
+		if s, isString := el.(*bzl.StringExpr); isString {
+			result = append(result, s.Value)
+		} else {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+func selectModeFlags(expr bzl.Expr) (ModeFlags, bool) {
+	call, isCall := expr.(*bzl.CallExpr)
+	if !isCall || len(call.List) != 1 {
+		return ModeFlags{}, false
+	}
+	if name, isIdent := call.X.(*bzl.Ident); !isIdent || name.Name != "select" {
+		return ModeFlags{}, false
+	}
+	dict, isDict := call.List[0].(*bzl.DictExpr)
+	if !isDict {
+		return ModeFlags{}, false
+	}
+	var result ModeFlags
+	for _, kv := range dict.List {
+		key, isString := kv.Key.(*bzl.StringExpr)
+		value, isList := exprStrings(kv.Value)
+		if !isString || !isList {
+			return ModeFlags{}, false
+		}
+		if key.Value == defaultCondition {
+			result.native = value
+		} else {
+			result.byte = value
+		}
+	}
+	return result, true
+}
+
+// Split the `opts` of an existing module into the common and the mode specific flags.
+func existingOpts(r *rule.Rule) ([]string, ModeFlags) {
+	expr := r.Attr("opts")
+	if expr == nil {
+		return nil, ModeFlags{}
+	}
+	if flags, isList := exprStrings(expr); isList {
+		return flags, ModeFlags{}
+	} else if isProfileOpts(expr) {
+		return nil, ModeFlags{}
+	} else if modeFlags, isSelect := selectModeFlags(expr); isSelect {
+		return nil, modeFlags
+	} else if sum, isSum := expr.(*bzl.BinaryExpr); isSum && sum.Op == "+" {
+		flags, isList := exprStrings(sum.X)
+		modeFlags, isSelect := selectModeFlags(sum.Y)
+		if isList && isSelect {
+			return flags, modeFlags
+		}
+	}
+	log.Printf("%s: ignoring unsupported opts", r.Name())
+	return nil, ModeFlags{}
+}
+
+// The compilation mode is passed to the executable rule as `mode`, the binary kind as linker options.
+func modeAttrs(r *rule.Rule, mode ExeMode) {
+	if mode.byte() {
+		r.SetAttr("mode", "bytecode")
+	} else {
+		r.SetAttr("mode", "native")
+	}
+	extendAttr(r, "opts", mode.opts())
+}
+
+// Remove the options added by `modeAttrs` from the options of an existing executable.
+func existingLinkFlags(r *rule.Rule, mode ExeMode) []string {
+	var result []string
+	for _, opt := range r.AttrStrings("opts") {
+		if !contains(opt, mode.opts()) {
+			result = append(result, opt)
+		}
+	}
+	return result
+}
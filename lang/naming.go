@@ -0,0 +1,199 @@
+package okapi
+
+import (
+	"log"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// Patterns for the names of generated targets.
+// `{name}` is replaced by the name of the library, executable or module, `{Name}` by the same name with `-` replaced
+// by `_` and the first letter capitalized, like the namespace module of a wrapped library.
+// Each pattern contains exactly one placeholder, so that the names can be reversed when updating a build file.
+type Naming struct {
+	library     string
+	namespace   string
+	executable  string
+	signature   string
+	lexer       string
+	parser      string
+	rule        string
+	stubs       string
+	inlineTests string
+	ppx         string
+	profile     string
+	copy        string
+}
+
+const (
+	namePlaceholder   = "{name}"
+	modulePlaceholder = "{Name}"
+	namingLibrary     = "library"
+	namingNamespace   = "namespace"
+	namingExecutable  = "executable"
+	namingSignature   = "signature"
+	namingLexer       = "lexer"
+	namingParser      = "parser"
+	namingRule        = "rule"
+	namingStubs       = "stubs"
+	namingInlineTests = "inline_tests"
+	namingPpx         = "ppx"
+	namingProfile     = "profile"
+	namingCopy        = "copy"
+)
+
+var defaultNaming = Naming{
+	library:     "lib-{name}",
+	namespace:   "#{Name}",
+	executable:  "exe-{name}",
+	signature:   "{name}__sig",
+	lexer:       "{name}_ml",
+	parser:      "{name}_parser",
+	rule:        "{name}_gen",
+	stubs:       "{name}_stubs",
+	inlineTests: "{name}_inline_tests",
+	ppx:         "ppx_{name}",
+	profile:     "profile_{name}",
+	copy:        "copied_by_{name}",
+}
+
+// Like OCaml module names, only the first letter is capitalized, so `foo_bar` becomes `Foo_bar`.
+func moduleCase(name string) string {
+	name = strings.ReplaceAll(name, "-", "_")
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func placeholder(pattern string) string {
+	if strings.Contains(pattern, modulePlaceholder) {
+		return modulePlaceholder
+	}
+	return namePlaceholder
+}
+
+func validPattern(pattern string) bool {
+	return strings.Count(pattern, namePlaceholder)+strings.Count(pattern, modulePlaceholder) == 1
+}
+
+func expandPattern(pattern string, name string) string {
+	if placeholder(pattern) == modulePlaceholder {
+		return strings.Replace(pattern, modulePlaceholder, moduleCase(name), 1)
+	}
+	return strings.Replace(pattern, namePlaceholder, name, 1)
+}
+
+// The inverse of `expandPattern`.
+// For `{Name}`, only the first letter is restored, since the replacement of `-` is ambiguous.
+func matchPattern(pattern string, target string) (string, bool) {
+	ph := placeholder(pattern)
+	parts := strings.SplitN(pattern, ph, 2)
+	prefix, suffix := parts[0], parts[1]
+	if len(target) <= len(prefix)+len(suffix) || !strings.HasPrefix(target, prefix) || !strings.HasSuffix(target, suffix) {
+		return "", false
+	}
+	name := target[len(prefix) : len(target)-len(suffix)]
+	if ph == modulePlaceholder {
+		if strings.ToUpper(name[:1]) != name[:1] {
+			return "", false
+		}
+		name = strings.ToLower(name[:1]) + name[1:]
+	}
+	return name, true
+}
+
+func (n Naming) libraryTarget(name string, wrapped bool) string {
+	if wrapped {
+		return expandPattern(n.namespace, name)
+	}
+	return expandPattern(n.library, name)
+}
+
+// Reverse the library target names created by `libraryTarget`.
+func (n Naming) libraryName(target string) (string, bool) {
+	if name, matched := matchPattern(n.library, target); matched {
+		return name, true
+	}
+	return matchPattern(n.namespace, target)
+}
+
+func (n Naming) executableTarget(publicName string) string {
+	return expandPattern(n.executable, publicName)
+}
+
+func (n Naming) executableName(target string) (string, bool) {
+	return matchPattern(n.executable, target)
+}
+
+func (n Naming) signatureTarget(module string) string { return expandPattern(n.signature, module) }
+
+func (n Naming) lexerTarget(module string) string { return expandPattern(n.lexer, module) }
+
+func (n Naming) parserTarget(module string) string { return expandPattern(n.parser, module) }
+
+// Genrules translated from Dune rules are named after their first target.
+func (n Naming) ruleTarget(target string) string { return expandPattern(n.rule, target) }
+
+func (n Naming) stubsTarget(libName string) string { return expandPattern(n.stubs, libName) }
+
+func (n Naming) inlineTestsTarget(libName string) string {
+	return expandPattern(n.inlineTests, libName)
+}
+
+func (n Naming) ppxTarget(libName string) string { return expandPattern(n.ppx, libName) }
+
+// The config settings of Dune profiles, see `Env`.
+func (n Naming) profileTarget(profile string) string { return expandPattern(n.profile, profile) }
+
+// The filegroups exporting the files that the package `pkg` copies with `copy_files`, which are named after that
+// package with `/` replaced by `_`.
+func (n Naming) copyTarget(pkg string) string {
+	return expandPattern(n.copy, strings.ReplaceAll(pkg, "/", "_"))
+}
+
+func (n Naming) isPpxTarget(target string) bool {
+	_, matched := matchPattern(n.ppx, target)
+	return matched
+}
+
+// `# gazelle:okapi_naming kind pattern`, where `kind` is one of the fields of `Naming`.
+func (n *Naming) directive(f *rule.File, d rule.Directive) {
+	parts := strings.Fields(d.Value)
+	if len(parts) != 2 {
+		log.Fatalf("%s: invalid `%s` directive, expected `kind pattern`: %s", f.Path, d.Key, d.Value)
+	}
+	kind, pattern := parts[0], parts[1]
+	if !validPattern(pattern) {
+		log.Fatalf("%s: invalid pattern in `%s` directive, expected exactly one `{name}` or `{Name}`: %s", f.Path, d.Key, pattern)
+	}
+	switch kind {
+	case namingLibrary:
+		n.library = pattern
+	case namingNamespace:
+		n.namespace = pattern
+	case namingExecutable:
+		n.executable = pattern
+	case namingSignature:
+		n.signature = pattern
+	case namingLexer:
+		n.lexer = pattern
+	case namingParser:
+		n.parser = pattern
+	case namingRule:
+		n.rule = pattern
+	case namingStubs:
+		n.stubs = pattern
+	case namingInlineTests:
+		n.inlineTests = pattern
+	case namingPpx:
+		n.ppx = pattern
+	case namingProfile:
+		n.profile = pattern
+	case namingCopy:
+		n.copy = pattern
+	default:
+		log.Fatalf("%s: unknown target kind in `%s` directive: %s", f.Path, d.Key, kind)
+	}
+}
@@ -0,0 +1,204 @@
+package okapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// An expression of Dune's ordered set language, which is used by fields like `modules` and `flags`.
+// A list is the union of its elements, and the elements after each `\` are removed from those before it.
+type orderedSet interface{}
+type setElement string
+type setStandard struct{}
+type setUnion []orderedSet
+type setDiff struct {
+	left  orderedSet
+	right orderedSet
+}
+
+func decodeSetUnion(nodes []SexpNode) (orderedSet, error) {
+	var result setUnion
+	for _, node := range nodes {
+		set, err := decodeOrderedSet(node)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, set)
+	}
+	return result, nil
+}
+
+// Parse a field in the ordered set language.
+// Includes that couldn't be expanded by `expandIncludes` are treated as empty sets, see `unexpandedIncludes`.
+func decodeOrderedSet(node SexpNode) (orderedSet, error) {
+	switch n := node.(type) {
+	case SexpString:
+		if n.Content == ":standard" {
+			return setStandard{}, nil
+		} else if n.Content == `\` || strings.HasPrefix(n.Content, ":") {
+			return nil, fmt.Errorf("unexpected %s", n.Content)
+		}
+		return setElement(n.Content), nil
+	case SexpEmpty:
+		return setUnion{}, nil
+	case SexpList:
+		if len(n.Sub) == 2 && n.Sub[0] == (SexpString{":include"}) {
+			return setUnion{}, nil
+		}
+		start := 0
+		var result orderedSet
+		for i := 0; i <= len(n.Sub); i++ {
+			if i < len(n.Sub) && n.Sub[i] != (SexpString{`\`}) {
+				continue
+			}
+			set, err := decodeSetUnion(n.Sub[start:i])
+			if err != nil {
+				return nil, err
+			}
+			if result == nil {
+				result = set
+			} else {
+				result = setDiff{result, set}
+			}
+			start = i + 1
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("invalid ordered set %#v", node)
+	}
+}
+
+func removeAll(items []string, removed []string) []string {
+	var result []string
+	for _, item := range items {
+		if !contains(item, removed) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Evaluate a set of strings like flags, where `:standard` stands for `standard`.
+// Unions keep the order and duplicates of their elements, like repeated `-open`, while differences remove every
+// occurrence of an element.
+func evalOrderedSet(set orderedSet, standard []string) []string {
+	switch s := set.(type) {
+	case setElement:
+		return []string{string(s)}
+	case setStandard:
+		return append([]string{}, standard...)
+	case setUnion:
+		var result []string
+		for _, sub := range s {
+			result = append(result, evalOrderedSet(sub, standard)...)
+		}
+		return result
+	case setDiff:
+		return removeAll(evalOrderedSet(s.left, standard), evalOrderedSet(s.right, standard))
+	default:
+		return nil
+	}
+}
+
+// A set of modules in terms of `:standard`, which stands for all modules of the directory: the modules of
+// `:standard` except for `excluded` if `standard` is set, and the modules listed explicitly.
+type moduleSet struct {
+	standard bool
+	excluded []string
+	modules  []string
+}
+
+func intersect(a []string, b []string) []string {
+	var result []string
+	for _, item := range a {
+		if contains(item, b) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Since listed modules are part of `:standard`, every expression can be reduced to a `moduleSet`.
+func evalModuleSet(set orderedSet) moduleSet {
+	switch s := set.(type) {
+	case setElement:
+		return moduleSet{modules: []string{string(s)}}
+	case setStandard:
+		return moduleSet{standard: true}
+	case setUnion:
+		var result moduleSet
+		for _, sub := range s {
+			part := evalModuleSet(sub)
+			if part.standard && result.standard {
+				result.excluded = intersect(result.excluded, part.excluded)
+			} else if part.standard {
+				result.standard = true
+				result.excluded = part.excluded
+			}
+			for _, mod := range part.modules {
+				result.modules = appendUnique(result.modules, mod)
+			}
+		}
+		return result
+	case setDiff:
+		left := evalModuleSet(s.left)
+		right := evalModuleSet(s.right)
+		result := moduleSet{modules: removeAll(left.modules, right.modules)}
+		if right.standard {
+			// Only the modules that are excluded from the right side remain.
+			result.modules = intersect(result.modules, right.excluded)
+			if left.standard {
+				for _, mod := range removeAll(right.excluded, append(append([]string{}, left.excluded...), right.modules...)) {
+					result.modules = appendUnique(result.modules, mod)
+				}
+			}
+		} else if left.standard {
+			result.standard = true
+			result.excluded = append(append([]string{}, left.excluded...), right.modules...)
+		}
+		return result
+	default:
+		return moduleSet{}
+	}
+}
+
+// The files of the includes in a field that weren't expanded by `expandIncludes`.
+func unexpandedIncludes(node SexpNode) []string {
+	l, isList := node.(SexpList)
+	if !isList {
+		return nil
+	}
+	if len(l.Sub) == 2 && l.Sub[0] == (SexpString{":include"}) {
+		file, _ := l.Sub[1].String()
+		return []string{file}
+	}
+	var result []string
+	for _, sub := range l.Sub {
+		result = append(result, unexpandedIncludes(sub)...)
+	}
+	return result
+}
+
+// Replace `(:include file)` with the contents of the file, if it exists in the source tree.
+// Files that are generated by rules can't be read, so those includes are kept and ignored by `decodeOrderedSet`.
+func expandIncludes(node SexpNode, dir string) SexpNode {
+	l, isList := node.(SexpList)
+	if !isList {
+		return node
+	}
+	if len(l.Sub) == 2 && l.Sub[0] == (SexpString{":include"}) {
+		if file, err := l.Sub[1].String(); err == nil {
+			if bytes, err := ioutil.ReadFile(filepath.Join(dir, file)); err == nil {
+				return SexpList{parseSexp(string(bytes))}
+			}
+		}
+		return node
+	}
+	var result []SexpNode
+	for _, sub := range l.Sub {
+		result = append(result, expandIncludes(sub, dir))
+	}
+	return SexpList{result}
+}
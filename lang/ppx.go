@@ -1,36 +1,206 @@
 package okapi
 
 import (
-	"github.com/bazelbuild/bazel-gazelle/rule"
+	"fmt"
+	"strings"
 )
 
-func ppxExecutable(name string, deps []string) *rule.Rule {
-	r := rule.NewRule("ppx_executable", ppxName(name))
-	r.SetAttr("deps_opam", deps)
-	r.SetAttr("main", "@obazl_rules_ocaml//dsl:ppx_driver")
-	return r
-}
-
 type PpxKind interface {
-	exe(name string) []RuleResult
+	exe(target string, backend Backend) []RuleResult
 	depsOpam() []string
 	isPpx() bool
 }
 
 type PpxTransitive struct{}
-type PpxDirect struct{ deps []string }
+
+// The rewriters from `pps` or `staged_pps`, which are linked into a ppx executable.
+type PpxDirect struct {
+	deps []string
+	// Arguments for the driver, like those after `--`
+	args []string
+	// Files used by the rewriters, from `preprocessor_deps`
+	data []string
+}
+
 type NoPpx struct{}
 
-func (PpxTransitive) exe(string) []RuleResult { return nil }
-func (ppx PpxDirect) exe(slug string) []RuleResult {
-	return []RuleResult{{ppxExecutable(slug, ppx.deps), nil}}
+// A ppx executable that exists in the build file already, so it isn't generated again
+type PpxExisting struct {
+	target string
+	deps   []string
+	args   []string
+	data   []string
 }
-func (NoPpx) exe(string) []RuleResult { return nil }
+
+// A preprocessor command from `(action (run ...))`, which is passed to the compiler with `-pp`.
+// The compiler appends the source file to the command, like Dune's `%{input-file}`.
+type PpxAction struct {
+	cmd string
+	// The programs from `%{bin:...}`, separated by spaces
+	tools string
+}
+
+const ocamlVersionVariable = "%{ocaml_version}"
+
+// The command with `%{ocaml_version}` replaced by the version from the directive `okapi_ocaml_version`.
+func (ppx PpxAction) command(conf *Config) (string, error) {
+	if !strings.Contains(ppx.cmd, ocamlVersionVariable) {
+		return ppx.cmd, nil
+	}
+	if conf.ocamlVersion == "" {
+		return "", fmt.Errorf("%s requires the directive `%s`", ocamlVersionVariable, ocamlVersionDirective)
+	}
+	return strings.ReplaceAll(ppx.cmd, ocamlVersionVariable, conf.ocamlVersion), nil
+}
+
+// Different preprocessing for some of the modules, from `per_module`.
+// Modules that aren't listed aren't preprocessed.
+type PpxPerModule struct {
+	specs []PpxKind
+	// The index of each module's spec
+	modules map[string]int
+}
+
+func (PpxTransitive) exe(string, Backend) []RuleResult { return nil }
+func (ppx PpxDirect) exe(target string, backend Backend) []RuleResult {
+	r := backend.ppxExecutable(target, ppx.deps)
+	tagGenerated(r)
+	return []RuleResult{{r, nil}}
+}
+func (NoPpx) exe(string, Backend) []RuleResult { return nil }
+func (PpxExisting) exe(string, Backend) []RuleResult {
+	return nil
+}
+func (PpxAction) exe(string, Backend) []RuleResult { return nil }
+
+// The executables of the specs are named after the modules' slugs, see `extraRules`.
+func (PpxPerModule) exe(string, Backend) []RuleResult { return nil }
 
 func (PpxTransitive) depsOpam() []string { return nil }
 func (ppx PpxDirect) depsOpam() []string { return ppx.deps }
 func (NoPpx) depsOpam() []string         { return nil }
+func (ppx PpxExisting) depsOpam() []string {
+	return ppx.deps
+}
+func (PpxAction) depsOpam() []string { return nil }
+func (ppx PpxPerModule) depsOpam() []string {
+	var result []string
+	for _, spec := range ppx.specs {
+		result = appendUnique(result, spec.depsOpam()...)
+	}
+	return result
+}
 
 func (PpxTransitive) isPpx() bool { return true }
 func (PpxDirect) isPpx() bool     { return true }
 func (NoPpx) isPpx() bool         { return false }
+func (PpxExisting) isPpx() bool   { return true }
+func (PpxAction) isPpx() bool     { return false }
+func (ppx PpxPerModule) isPpx() bool {
+	for _, spec := range ppx.specs {
+		if spec.isPpx() {
+			return true
+		}
+	}
+	return false
+}
+
+// The runtime libraries of common rewriters, which Dune reads from their `ppx_runtime_libraries`.
+// Others can be declared with the directive `okapi_ppx_codeps`.
+var defaultPpxRuntime = map[string][]string{
+	"ppx_inline_test":     {"ppx_inline_test.runtime-lib"},
+	"ppx_bench":           {"ppx_bench.runtime-lib"},
+	"ppx_sexp_conv":       {"sexplib0"},
+	"ppx_deriving.show":   {"ppx_deriving.runtime"},
+	"ppx_deriving.eq":     {"ppx_deriving.runtime"},
+	"ppx_deriving.ord":    {"ppx_deriving.runtime"},
+	"ppx_deriving_yojson": {"ppx_deriving_yojson.runtime"},
+}
+
+// The runtime libraries of the rewriters in `deps`.
+func (conf *Config) ppxCodeps(deps []string) []string {
+	var result []string
+	for _, dep := range deps {
+		result = appendUnique(result, conf.ppxRuntime[dep]...)
+	}
+	return result
+}
+
+// The executables of the specs of `per_module` are distinguished by their index.
+func perModuleTarget(slug string, index int) string { return fmt.Sprintf("%s-%d", slug, index) }
+
+// The preprocessing of a single module, along with the name of its ppx executable.
+func modulePpx(kind PpxKind, slug string, module string) (PpxKind, string) {
+	if ppx, isPerModule := kind.(PpxPerModule); isPerModule {
+		if index, exists := ppx.modules[module]; exists {
+			return ppx.specs[index], perModuleTarget(slug, index)
+		}
+		return NoPpx{}, slug
+	}
+	return kind, slug
+}
+
+// Split the `-pp` option, which is generated for `PpxAction`, from other compiler options.
+func splitPpOption(opts []string) ([]string, string) {
+	var rest []string
+	cmd := ""
+	for i := 0; i < len(opts); i++ {
+		if opts[i] == "-pp" && i+1 < len(opts) {
+			cmd = opts[i+1]
+			i++
+		} else {
+			rest = append(rest, opts[i])
+		}
+	}
+	return rest, cmd
+}
+
+func ppOption(cmd string) []string { return []string{"-pp", cmd} }
+
+// Whether all modules use the same preprocessing, compared by their attributes.
+func uniformPpx(kinds map[string]PpxKind) (PpxKind, bool) {
+	var first PpxKind
+	for _, kind := range kinds {
+		if first == nil {
+			first = kind
+		} else if fmt.Sprintf("%#v", first) != fmt.Sprintf("%#v", kind) {
+			return nil, false
+		}
+	}
+	return first, true
+}
+
+// Reconstruct the preprocessing of existing modules.
+// If all modules are preprocessed in the same way, new modules are preprocessed like them, as with a Dune config that
+// doesn't use `per_module`.
+func existingPerModule(kinds map[string]PpxKind, modules []string) PpxKind {
+	preprocessed := 0
+	for _, name := range modules {
+		if _, exists := kinds[name]; exists {
+			preprocessed++
+		}
+	}
+	if preprocessed == 0 {
+		return NoPpx{}
+	}
+	if kind, uniform := uniformPpx(kinds); uniform && preprocessed == len(modules) {
+		return kind
+	}
+	result := PpxPerModule{modules: make(map[string]int)}
+	keys := make(map[string]int)
+	for _, name := range modules {
+		kind, exists := kinds[name]
+		if !exists {
+			continue
+		}
+		key := fmt.Sprintf("%#v", kind)
+		index, known := keys[key]
+		if !known {
+			index = len(result.specs)
+			keys[key] = index
+			result.specs = append(result.specs, kind)
+		}
+		result.modules[name] = index
+	}
+	return result
+}
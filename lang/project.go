@@ -0,0 +1,191 @@
+package okapi
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A package declared in `dune-project`.
+type DunePackage struct {
+	name string
+	// The OPAM packages from `depends`, without version constraints
+	depends []string
+}
+
+// The settings of a `dune-project` file, which apply to all directories below it, up to the next `dune-project`.
+type DuneProject struct {
+	// The version from `(lang dune X)`, as major and minor version
+	lang [2]int
+	// Whether modules may use the dependencies of their dependencies, or only their re-exports
+	implicitTransitiveDeps bool
+	// Whether the main modules of executables without an interface get an empty one
+	executablesImplicitEmptyIntf bool
+	packages                     []DunePackage
+}
+
+// The defaults of directories without a `dune-project`, which are those of the oldest version Okapi supports.
+var defaultProject = projectDefaults([2]int{1, 0})
+
+func atLeast(version [2]int, major int, minor int) bool {
+	return version[0] > major || (version[0] == major && version[1] >= minor)
+}
+
+// Some defaults depend on the language version.
+func projectDefaults(lang [2]int) DuneProject {
+	return DuneProject{
+		lang:                         lang,
+		implicitTransitiveDeps:       true,
+		executablesImplicitEmptyIntf: atLeast(lang, 3, 0),
+	}
+}
+
+func parseLangVersion(version string) ([2]int, bool) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return [2]int{}, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return [2]int{}, false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return [2]int{}, false
+	}
+	return [2]int{major, minor}, true
+}
+
+// Boolean options are either `(option)` or `(option true|false)`.
+func projectBool(stanza []SexpNode, def bool) bool {
+	if len(stanza) == 1 {
+		return true
+	} else if value, err := stanza[1].String(); err == nil {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	log.Printf("dune-project: invalid value for %#v", stanza)
+	return def
+}
+
+// The elements of `depends` are either package names or lists of a name and a constraint.
+func decodeDepends(depends SexpNode) []string {
+	var result []string
+	items, _ := depends.List()
+	for _, item := range items {
+		if name, err := item.String(); err == nil {
+			result = append(result, name)
+		} else if l, err := item.List(); err == nil && len(l) > 0 {
+			if name, err := l[0].String(); err == nil {
+				result = append(result, name)
+			}
+		}
+	}
+	return result
+}
+
+func decodeDunePackage(stanza []SexpNode) (DunePackage, bool) {
+	pkg, isMap := sexpMap(stanza).(SexpMap)
+	if !isMap {
+		return DunePackage{}, false
+	}
+	raw, exists := pkg.Values["name"]
+	if !exists {
+		return DunePackage{}, false
+	}
+	name, err := raw.String()
+	if err != nil {
+		return DunePackage{}, false
+	}
+	var depends []string
+	if raw, exists := pkg.Values["depends"]; exists {
+		depends = decodeDepends(raw)
+	}
+	return DunePackage{name, depends}, true
+}
+
+// Parse a `dune-project` file.
+// The language version has to be read first, since it determines the defaults of the other settings.
+func decodeDuneProject(nodes []SexpNode) DuneProject {
+	var stanzas [][]SexpNode
+	lang := defaultProject.lang
+	for _, node := range nodes {
+		l, isList := node.(SexpList)
+		if !isList || len(l.Sub) == 0 {
+			continue
+		}
+		ss, err := sexpStrings(l)
+		if err == nil && len(ss) == 3 && ss[0] == "lang" && ss[1] == "dune" {
+			if version, valid := parseLangVersion(ss[2]); valid {
+				lang = version
+			} else {
+				log.Printf("dune-project: invalid lang version %s", ss[2])
+			}
+		}
+		stanzas = append(stanzas, l.Sub)
+	}
+	project := projectDefaults(lang)
+	for _, stanza := range stanzas {
+		name, _ := stanza[0].String()
+		switch name {
+		case "implicit_transitive_deps":
+			project.implicitTransitiveDeps = projectBool(stanza, project.implicitTransitiveDeps)
+		case "executables_implicit_empty_intf":
+			project.executablesImplicitEmptyIntf = projectBool(stanza, project.executablesImplicitEmptyIntf)
+		case "package":
+			if pkg, valid := decodeDunePackage(stanza); valid {
+				project.packages = append(project.packages, pkg)
+			} else {
+				log.Printf("dune-project: invalid package %#v", stanza)
+			}
+		}
+	}
+	return project
+}
+
+// Parse the `dune-project` file in `dir`, if there is one.
+func readDuneProject(dir string) (DuneProject, bool) {
+	path := filepath.Join(dir, "dune-project")
+	if _, err := os.Stat(path); err != nil {
+		return DuneProject{}, false
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("%s: %s", path, err)
+	}
+	return decodeDuneProject(parseSexp(string(bytes))), true
+}
+
+// The package a library or executable belongs to, determined by its public name like `pkg.sub`.
+func (project DuneProject) packageOf(publicName string) (DunePackage, bool) {
+	name := strings.SplitN(publicName, ".", 2)[0]
+	for _, pkg := range project.packages {
+		if pkg.name == name {
+			return pkg, true
+		}
+	}
+	return DunePackage{}, false
+}
+
+// Libraries that are distributed with the compiler, which aren't listed in `depends`.
+var compilerLibraries = []string{"unix", "str", "threads", "dynlink", "bigarray", "compiler-libs", "stdlib", "ocaml"}
+
+// Report OPAM dependencies of a component that aren't declared in the `depends` of its package.
+// Libraries of the project's own packages don't have to be declared.
+func (project DuneProject) checkDepends(component ComponentName, deps []string) {
+	pkg, exists := project.packageOf(component.public)
+	if !exists {
+		return
+	}
+	for _, dep := range deps {
+		name := strings.SplitN(dep, ".", 2)[0]
+		_, isLocal := project.packageOf(name)
+		if !isLocal && !contains(name, pkg.depends) && !contains(name, compilerLibraries) {
+			log.Printf("dune-project: %s uses %s, which isn't in the depends of package %s", component.public, dep, pkg.name)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Gazelle language that generates build files for the current `rules_ocaml` API.
+// Use `@okapi//lang/rules_ocaml` instead of `@okapi//lang` in the `gazelle_binary`.
+package rules_ocaml
+
+import (
+	"github.com/bazelbuild/bazel-gazelle/language"
+	okapi "github.com/tweag/okapi/lang"
+)
+
+// Entry point to Gazelle
+func NewLanguage() language.Language { return okapi.NewRulesOcamlLanguage() }
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 type SexpError struct{ msg string }
@@ -18,8 +20,13 @@ type SexpNode interface {
 type SexpMap struct {
 	Name   string
 	Values map[string]SexpNode
+	// All values of the fields in `repeatedFields`, whose first value is in `Values`
+	Repeated map[string][]SexpNode
 }
 
+// Fields that may occur more than once in a stanza.
+var repeatedFields = map[string]bool{"foreign_stubs": true}
+
 func (m SexpMap) List() ([]SexpNode, error) {
 	return nil, SexpError{fmt.Sprintf("SexpMap %#v cannot be converted to list", m)}
 }
@@ -81,9 +88,10 @@ func sexpStrings(node SexpNode) ([]string, error) {
 }
 
 func sexpMap(elements []SexpNode) SexpNode {
-	if len(elements) > 2 {
+	if len(elements) >= 2 {
 		canMap := false
 		smap := make(map[string]SexpNode)
+		repeated := make(map[string][]SexpNode)
 		name, nameIsString := elements[0].(SexpString)
 		if nameIsString {
 			canMap = true
@@ -91,7 +99,7 @@ func sexpMap(elements []SexpNode) SexpNode {
 				l, isList := node.(SexpList)
 				if isList && len(l.Sub) >= 1 {
 					s, isString := l.Sub[0].(SexpString)
-					if isString && smap[s.Content] == nil {
+					if isString && (smap[s.Content] == nil || repeatedFields[s.Content]) {
 						var value SexpNode
 						if len(l.Sub) == 2 {
 							s, sErr := l.Sub[1].String()
@@ -105,7 +113,12 @@ func sexpMap(elements []SexpNode) SexpNode {
 						} else {
 							value = SexpList{l.Sub[1:]}
 						}
-						smap[s.Content] = value
+						if smap[s.Content] == nil {
+							smap[s.Content] = value
+						}
+						if repeatedFields[s.Content] {
+							repeated[s.Content] = append(repeated[s.Content], value)
+						}
 					} else {
 						canMap = false
 					}
@@ -115,7 +128,11 @@ func sexpMap(elements []SexpNode) SexpNode {
 			}
 		}
 		if canMap {
-			return SexpMap{name.Content, smap}
+			result := SexpMap{Name: name.Content, Values: smap}
+			if len(repeated) > 0 {
+				result.Repeated = repeated
+			}
+			return result
 		}
 	}
 	return SexpList{elements}
@@ -130,6 +147,8 @@ func sexp(tokens []string) (SexpNode, []string) {
 			return SexpList{sub}, rest
 		} else if head == ")" {
 			return SexpEmpty{}, tail
+		} else if strings.HasPrefix(head, `"`) {
+			return SexpString{unquote(head)}, tail
 		} else {
 			return SexpString{head}, tail
 		}
@@ -159,14 +178,20 @@ func sexpList(tokens []string) ([]SexpNode, []string) {
 	return result, cur
 }
 
+// Quoted strings, like the commands in `(system "...")`, use OCaml escapes, which mostly agree with Go's.
+func unquote(token string) string {
+	if s, err := strconv.Unquote(token); err == nil {
+		return s
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(token, `"`), `"`)
+}
+
 func parseSexp(code string) []SexpNode {
 	var tokens []string
-	rex := regexp.MustCompile(`\(|\)|\s+|[^()\s]+`)
+	rex := regexp.MustCompile(`"(?:[^"\\]|\\.)*"|;[^\n]*|\(|\)|\s+|[^()\s]+`)
 	ws := regexp.MustCompile(`^\s+$`)
-	comment := regexp.MustCompile(`;.*\n`)
-	withoutComments := comment.ReplaceAllString(code, "")
-	for _, match := range rex.FindAllString(withoutComments, -1) {
-		if !ws.MatchString(match) {
+	for _, match := range rex.FindAllString(code, -1) {
+		if !ws.MatchString(match) && !strings.HasPrefix(match, ";") {
 			tokens = append(tokens, match)
 		}
 	}
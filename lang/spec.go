@@ -1,5 +1,11 @@
 package okapi
 
+import (
+	"log"
+
+	bzl "github.com/bazelbuild/buildtools/build"
+)
+
 // A `modules` stanza (may be absent, in that case `auto = true`)
 type ModuleSpec interface {
 	names() []string
@@ -9,7 +15,6 @@ type ModuleSpec interface {
 
 // AutoModules implements ModuleSpec
 // Either `:standard` or unspecified
-// Note: limitation: a `modules` stanza can contain both `:standard` and concrete modules
 type AutoModules struct{}
 
 // ConcreteModules implements ModuleSpec
@@ -18,8 +23,10 @@ type ConcreteModules struct {
 }
 
 // ExcludeModules implements ModuleSpec
+// `:standard` without some modules, and possibly with modules that are listed explicitly
 type ExcludeModules struct {
-	modules []string
+	excluded []string
+	modules  []string
 }
 
 type SourcesSpec struct {
@@ -32,16 +39,24 @@ type SourcesSpec struct {
 	depsOpam []string
 	kind     KindSpec
 	flags    []string
-	mains    []string
+	// `ocamlc_flags` and `ocamlopt_flags` in Dune lingo
+	modeFlags ModeFlags
+	// The flag fields of Dune stanzas, which are evaluated for each profile instead of `flags` and `modeFlags`, or nil
+	fields *FlagFields
+	// The `opts` of existing modules that select the flags of the profiles, or nil
+	profileOpts bzl.Expr
+	// `enabled_if` in Dune lingo, or nil
+	enabledIf Compatibility
+	mains     []string
 }
 
 func (AutoModules) names() []string          { return nil }
 func (spec ConcreteModules) names() []string { return spec.modules }
-func (ExcludeModules) names() []string       { return nil }
+func (spec ExcludeModules) names() []string  { return spec.modules }
 
 func (AutoModules) specifies(string) bool                 { return false }
 func (spec ConcreteModules) specifies(target string) bool { return contains(target, spec.modules) }
-func (ExcludeModules) specifies(string) bool              { return false }
+func (spec ExcludeModules) specifies(target string) bool  { return contains(target, spec.modules) }
 
 func (AutoModules) auto() bool     { return true }
 func (ConcreteModules) auto() bool { return false }
@@ -63,11 +78,27 @@ type LibSpec struct {
 	wrapped        bool
 	virtualModules []string
 	implements     string
+	stubs          ForeignStubs
+	inlineTests    *InlineTests
+	// `private_modules` in Dune lingo
+	privateModules []string
+	// `modules_without_implementation` in Dune lingo
+	noImpl []string
+	// The libraries from `re_export`
+	reExports []string
+	// The implementation that is linked into executables using a virtual library, if they don't link another one
+	defaultImpl string
 }
 
 // ExeSpec implements KindSpec
 type ExeSpec struct {
 	test bool
+	// The `modes` of the executables, where nil means the default native mode
+	modes []ExeMode
+	// `link_flags` in Dune lingo
+	linkFlags []string
+	// `executables_implicit_empty_intf` in the `dune-project`
+	emptyIntf bool
 }
 
 // LibSpec implements KindSpec
@@ -76,10 +107,20 @@ func (lib LibSpec) toObazl(ppx PpxKind, sources Deps) ComponentKind {
 	for _, mod := range lib.virtualModules {
 		modules = append(modules, sources[mod])
 	}
+	for _, mod := range lib.noImpl {
+		if src, exists := sources[mod]; exists && !src.virtual {
+			log.Printf("library %s: module %s in modules_without_implementation has an implementation", lib.name.name, mod)
+		}
+	}
 	return Library{
 		name:           lib.name,
 		virtualModules: modules,
 		implements:     lib.implements,
+		stubs:          lib.stubs,
+		inlineTests:    lib.inlineTests,
+		privateModules: lib.privateModules,
+		reExports:      lib.reExports,
+		defaultImpl:    lib.defaultImpl,
 		kind:           libKind(ppx.isPpx(), lib.wrapped),
 	}
 }
@@ -91,8 +132,11 @@ func (spec ExeSpec) toObazl(ppx PpxKind, sources Deps) ComponentKind {
 		kind = ExePpx{}
 	}
 	return Executable{
-		kind: kind,
-		test: spec.test,
+		kind:      kind,
+		test:      spec.test,
+		modes:     spec.modes,
+		linkFlags: spec.linkFlags,
+		emptyIntf: spec.emptyIntf,
 	}
 }
 
@@ -107,4 +151,6 @@ type PackageSpec struct {
 	components []ComponentSpec
 	modules    map[int]SourcesSpec
 	generated  []string
+	// Dune rules, which are translated to genrules when generating and updating build files
+	rules []DuneRule
 }
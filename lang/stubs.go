@@ -0,0 +1,166 @@
+package okapi
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/config"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"github.com/bazelbuild/bazel-gazelle/resolve"
+	"github.com/bazelbuild/bazel-gazelle/rule"
+)
+
+// Foreign sources that are compiled with the same flags.
+type ForeignSources struct {
+	// Source files, relative to the package
+	srcs []string
+	// Compiler flags
+	flags []string
+}
+
+// The foreign code of a library, which is compiled by one `cc_library` for each set of flags.
+type ForeignStubs struct {
+	// The sources of `c_names` and the `foreign_stubs` fields, grouped by their flags
+	sources []ForeignSources
+	// Linker flags, from `c_library_flags`
+	libraryFlags []string
+	// Prebuilt archives from `foreign_archives`
+	archives []string
+}
+
+func (stubs ForeignStubs) empty() bool { return len(stubs.sources) == 0 && len(stubs.archives) == 0 }
+
+// Add sources to the group with the same flags, or to a new one.
+func (stubs *ForeignStubs) add(srcs []string, flags []string) {
+	if len(srcs) == 0 {
+		return
+	}
+	for i, group := range stubs.sources {
+		if equalStrings(group.flags, flags) {
+			stubs.sources[i].srcs = append(group.srcs, srcs...)
+			return
+		}
+	}
+	stubs.sources = append(stubs.sources, ForeignSources{srcs, flags})
+}
+
+var foreignExtensions = map[string]string{"c": ".c", "cxx": ".cpp"}
+
+// Parse the fields `foreign_stubs`, `c_names`, `c_flags`, `c_library_flags` and `foreign_archives` of a library.
+// `foreign_stubs` may be repeated, for example for sources in C and C++, and `c_flags` only apply to `c_names`.
+func decodeForeignStubs(lib SexpComponent) ForeignStubs {
+	stubs := ForeignStubs{libraryFlags: lib.list("c_library_flags")}
+	var cNames []string
+	for _, name := range lib.list("c_names") {
+		cNames = append(cNames, name+".c")
+	}
+	stubs.add(cNames, lib.list("c_flags"))
+	for _, foreign := range lib.fields("foreign_stubs") {
+		ext, supported := foreignExtensions[foreign.string("language")]
+		if !supported {
+			lib.fatalf("unsupported language in foreign_stubs: %s", foreign.string("language"))
+		}
+		var srcs []string
+		for _, name := range foreign.list("names") {
+			srcs = append(srcs, name+ext)
+		}
+		stubs.add(srcs, foreign.list("flags"))
+	}
+	for _, archive := range lib.list("foreign_archives") {
+		stubs.archives = append(stubs.archives, "lib"+archive+".a")
+	}
+	return stubs
+}
+
+// The first `cc_library` is named after the library, the others get the index of their group as a suffix.
+func stubsTarget(libName string, index int, naming Naming) string {
+	if index == 0 {
+		return naming.stubsTarget(libName)
+	}
+	return naming.stubsTarget(fmt.Sprintf("%s_%d", libName, index))
+}
+
+// Headers in the package are available to the stubs in Dune, so they are included with a glob.
+// The archives and linker flags are added to the first rule.
+// The rules are annotated with the library's public name, so that they are found when updating.
+func stubsRules(lib Library, publicName string, conf *Config) []*rule.Rule {
+	groups := lib.stubs.sources
+	if len(groups) == 0 {
+		groups = []ForeignSources{{}}
+	}
+	var result []*rule.Rule
+	for i, group := range groups {
+		r := rule.NewRule("cc_library", stubsTarget(lib.name.name, i, conf.naming))
+		srcs := group.srcs
+		if i == 0 {
+			srcs = append(append([]string{}, srcs...), lib.stubs.archives...)
+		}
+		r.SetAttr("srcs", prefixColon(srcs))
+		r.SetAttr("hdrs", rule.GlobValue{Patterns: []string{"*.h"}})
+		extendAttr(r, "copts", group.flags)
+		if i == 0 {
+			extendAttr(r, "linkopts", lib.stubs.libraryFlags)
+		}
+		r.AddComment("# okapi:stubs " + publicName)
+		r.SetAttr("visibility", []string{"//visibility:public"})
+		result = append(result, r)
+	}
+	return result
+}
+
+// Sort the stubs of a library, starting with `first`, which is named after the library.
+func sortStubs(names []string, first string) {
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == first || names[j] == first {
+			return names[i] == first
+		}
+		return names[i] < names[j]
+	})
+}
+
+// Rebuild the stubs of a library from the `cc_library` rules annotated with its public name, starting with the one
+// named after the library.
+func existingStubs(name ComponentName, rules map[string]*rule.Rule, naming Naming) ForeignStubs {
+	var names []string
+	for target, r := range rules {
+		if lib, isStubs := ruleConfig(r, "stubs"); isStubs && lib == name.public && r.Kind() == "cc_library" {
+			names = append(names, target)
+		}
+	}
+	sortStubs(names, naming.stubsTarget(name.name))
+	var stubs ForeignStubs
+	for _, target := range names {
+		r := rules[target]
+		var srcs []string
+		for _, src := range r.AttrStrings("srcs") {
+			if filepath.Ext(src) == ".a" {
+				stubs.archives = append(stubs.archives, removeColon(src))
+			} else {
+				srcs = append(srcs, removeColon(src))
+			}
+		}
+		stubs.add(srcs, r.AttrStrings("copts"))
+		stubs.libraryFlags = append(stubs.libraryFlags, r.AttrStrings("linkopts")...)
+	}
+	return stubs
+}
+
+// Add the `cc_library` rules of a library's stubs to its `cc_deps`, which are found in the index by the public name
+// they are annotated with, see `Imports`.
+func resolveStubs(c *config.Config, ix *resolve.RuleIndex, r *rule.Rule, from label.Label) {
+	name, isComponent := ruleConfig(r, "public_name")
+	if !isComponent {
+		return
+	}
+	var labels []string
+	for _, result := range findImport(c, ix, "stubs:"+name) {
+		labels = append(labels, result.Label.Rel(from.Repo, from.Pkg).String())
+	}
+	if len(labels) == 0 {
+		return
+	}
+	naming := getConfig(c).naming
+	sortStubs(labels, ":"+naming.stubsTarget(slug(r.Name(), naming)))
+	getConfig(c).backend.ccDeps(r, labels)
+}
@@ -87,12 +87,14 @@ okapi_setup_legacy()
 
 const aBuildTarget = `load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library", "ocaml_signature")
 
+# okapi:generated
 ocaml_signature(
     name = "a2__sig",
     src = ":a2.mli",
     deps = [":f1"],
 )
 
+# okapi:generated
 ocaml_module(
     name = "a2",
     sig = ":a2__sig",
@@ -100,6 +102,7 @@ ocaml_module(
     deps = [":f1"],
 )
 
+# okapi:generated
 ocaml_module(
     name = "a3",
     struct = ":a3.ml",
@@ -109,11 +112,13 @@ ocaml_module(
     ],
 )
 
+# okapi:generated
 ocaml_signature(
     name = "f1__sig",
     src = ":f1.mli",
 )
 
+# okapi:generated
 ocaml_module(
     name = "f1",
     sig = ":f1__sig",
@@ -135,12 +140,15 @@ ocaml_ns_library(
 
 const subBuildTarget = `load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library", "ppx_executable", "ppx_module", "ppx_ns_library")
 
+# okapi:generated
 ppx_executable(
     name = "ppx_set-0",
     deps_opam = ["ppx_inline_test"],
     main = "@obazl_rules_ocaml//dsl:ppx_driver",
 )
 
+# okapi:generated
+# okapi:choices choice1.ml choice2.ml
 ppx_module(
     name = "final",
     deps_opam = [
@@ -159,6 +167,7 @@ ppx_module(
     struct = ":final.ml",
 )
 
+# okapi:generated
 ppx_module(
     name = "sub",
     deps_opam = [
@@ -177,12 +186,14 @@ ppx_module(
     struct = ":sub.ml",
 )
 
+# okapi:generated
 ocaml_module(
     name = "bar",
     struct = ":bar.ml",
     deps = ["//a:#A"],
 )
 
+# okapi:generated
 ocaml_module(
     name = "foo",
     struct = ":foo.ml",
@@ -192,6 +203,7 @@ ocaml_module(
     ],
 )
 
+# okapi:libraries a
 # okapi:public_name sub-extra-lib
 ocaml_ns_library(
     name = "#Sub_extra_lib",
@@ -202,6 +214,7 @@ ocaml_ns_library(
     visibility = ["//visibility:public"],
 )
 
+# okapi:libraries angstrom re ipaddr
 # okapi:auto
 # okapi:public_name sub-lib
 ppx_ns_library(
@@ -39,11 +39,13 @@ okapi_setup_legacy()
 const libBuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library")
 
+# okapi:generated
 ocaml_module(
     name = "m4",
     struct = ":m4.ml",
 )
 
+# okapi:generated
 ocaml_module(
     name = "m1",
     struct = ":m1.ml",
@@ -41,12 +41,14 @@ okapi_setup_legacy()
 const libBuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library", "ocaml_signature")
 
+# okapi:generated
 ocaml_signature(
     name = "prog__sig",
     src = ":prog.mli",
     deps = [":sig"],
 )
 
+# okapi:generated
 ocaml_module(
     name = "prog",
     sig = ":prog__sig",
@@ -54,6 +56,7 @@ ocaml_module(
     deps = [":sig"],
 )
 
+# okapi:generated
 ocaml_module(
     name = "sig",
     struct = ":sig.ml",
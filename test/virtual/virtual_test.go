@@ -73,6 +73,7 @@ const virtBuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_ns_library", "ocaml_signature")
 
 # okapi:virt virt
+# okapi:generated
 ocaml_signature(
     name = "virty",
     src = ":virty.mli",
@@ -91,6 +92,7 @@ const impl1BuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library")
 
 # okapi:implements virt
+# okapi:generated
 ocaml_module(
     name = "virty",
     struct = ":virty.ml",
@@ -111,6 +113,7 @@ const impl2BuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library")
 
 # okapi:implements virt
+# okapi:generated
 ocaml_module(
     name = "virty",
     struct = ":virty.ml",
@@ -130,12 +133,14 @@ ocaml_ns_library(
 const depBuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_module", "ocaml_ns_library", "ocaml_signature")
 
+# okapi:generated
 ocaml_signature(
     name = "deppy__sig",
     src = ":deppy.mli",
     deps = ["//virt:#Virt"],
 )
 
+# okapi:generated
 ocaml_module(
     name = "deppy",
     sig = ":deppy__sig",
@@ -143,6 +148,7 @@ ocaml_module(
     deps = ["//virt:#Virt"],
 )
 
+# okapi:libraries virt
 # okapi:auto
 # okapi:public_name dep
 ocaml_ns_library(
@@ -155,6 +161,7 @@ ocaml_ns_library(
 const exeBuildTarget = `
 load("@obazl_rules_ocaml//ocaml:rules.bzl", "ocaml_executable", "ocaml_module")
 
+# okapi:generated
 ocaml_module(
     name = "main",
     struct = ":main.ml",